@@ -27,6 +27,7 @@ func CreateLayer(xtra ...fx.Option) *fx.App {
 			web.Register,
 			web.NewDatasetHandler,
 			web.NewPostHandler,
+			web.NewConfigHandler,
 		),
 	}
 	opts = append(xtra, opts...)
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strings"
 )
 
 type Datalayer struct {
@@ -23,26 +26,98 @@ type Datalayer struct {
 }
 
 type TableMapping struct {
+	TableName            string                    `json:"tableName"`
+	DatasetName          string                    `json:"datasetName"`
+	NameSpace            string                    `json:"nameSpace"`
+	CustomQuery          string                    `json:"query"`
+	CDCEnabled           bool                      `json:"cdcEnabled"`
+	CDCNetChanges        bool                      `json:"cdcNetChanges"`
+	CaptureInstance      string                    `json:"captureInstance"`
+	CDCRowFilter         string                    `json:"cdcRowFilter"`
+	ChangeTracking       bool                      `json:"changeTrackingEnabled"`
+	SinceColumn          string                    `json:"sinceColumn"`
+	RowVersionColumn     string                    `json:"rowVersionColumn"`
+	SoftDeleteColumn     string                    `json:"softDeleteColumn"` // column that marks a row deleted
+	SoftDeleteValue      string                    `json:"softDeleteValue"`  // value of it that means deleted, any but null and false by default
+	EntityIdConstructor  string                    `json:"entityIdConstructor"`
+	Types                []string                  `json:"types"`
+	ColumnMappings       []*ColumnMapping          `json:"columnMappings"`
+	Config               *TableConfig              `json:"config"`
+	TimeZone             string                    `json:"timezone"`
+	ExactDecimals        bool                      `json:"exactDecimals"`
+	ChildReferences      []*ChildReference         `json:"childReferences"`
+	EmbeddedEntities     []*EmbeddedEntity         `json:"embeddedEntities"`
+	ForeignKeyReferences bool                      `json:"foreignKeyReferences"`
+	Procedure            *ProcedureMapping         `json:"procedure"`
+	Columns              map[string]*ColumnMapping `json:"-"`
+}
+
+// ChildReference aggregates the rows of a child table that point at an entity, through a
+// foreign key, into a list of references on it.
+type ChildReference struct {
+	TableName         string `json:"tableName"`
+	ForeignKey        string `json:"foreignKey"`   // column of the child table that holds the key of the parent
+	ParentColumn      string `json:"parentColumn"` // column the foreign key points at, the id column by default
+	KeyColumn         string `json:"keyColumn"`    // column of the child table that goes into the reference template
+	PropertyName      string `json:"propertyName"`
+	ReferenceTemplate string `json:"referenceTemplate"`
+}
+
+// EmbeddedEntity nests the rows of a child table that point at an entity, through a foreign
+// key, as sub-entities in a property of it.
+type EmbeddedEntity struct {
 	TableName           string           `json:"tableName"`
-	NameSpace           string           `json:"nameSpace"`
-	CustomQuery         string           `json:"query"`
-	CDCEnabled          bool             `json:"cdcEnabled"`
-	SinceColumn         string           `json:"sinceColumn"`
+	ForeignKey          string           `json:"foreignKey"`   // column of the child table that holds the key of the parent
+	ParentColumn        string           `json:"parentColumn"` // column the foreign key points at, the id column by default
+	PropertyName        string           `json:"propertyName"`
 	EntityIdConstructor string           `json:"entityIdConstructor"`
 	Types               []string         `json:"types"`
+	SinceColumn         string           `json:"sinceColumn"` // re-emits the parents of rows changed after the since token
+	CDCEnabled          bool             `json:"cdcEnabled"`  // re-emits the parents of rows changed in the lsn range read
+	CaptureInstance     string           `json:"captureInstance"`
 	ColumnMappings      []*ColumnMapping `json:"columnMappings"`
-	Config              *TableConfig     `json:"config"`
-	TimeZone            string           `json:"timezone"`
-	Columns             map[string]*ColumnMapping
+}
+
+// ProcedureMapping reads a dataset from the result sets of a stored procedure, or of an inline
+// table valued function, instead of from a table.
+type ProcedureMapping struct {
+	Name           string               `json:"name"`           // the table name by default
+	Function       bool                 `json:"function"`       // read with SELECT * FROM name(arguments)
+	SinceParameter string               `json:"sinceParameter"` // in/out parameter that takes and returns the since token
+	Arguments      []*ProcedureArgument `json:"arguments"`
+}
+
+// ProcedureArgument is an argument of a procedure or function. It is bound from the config, the
+// since token or limit of the request, or an allowed query parameter of the request.
+type ProcedureArgument struct {
+	Name       string `json:"name"`
+	Type       string `json:"type"`       // string (default), int, float, bool, datetime or date
+	Source     string `json:"source"`     // config (default), since, limit or query
+	Value      string `json:"value"`      // the value from config, or the default of a query parameter
+	QueryParam string `json:"queryParam"` // the query parameter of a query argument, its name by default
 }
 
 type ColumnMapping struct {
-	FieldName         string `json:"fieldName"`
+	FieldName          string             `json:"fieldName"`
+	PropertyName       string             `json:"propertyName"`
+	IsIdColumn         bool               `json:"isIdColumn"`
+	IsReference        bool               `json:"isReference"`
+	ReferenceTemplate  string             `json:"referenceTemplate"`
+	ReferenceDelimiter string             `json:"referenceDelimiter"`
+	IgnoreColumn       bool               `json:"ignoreColumn"`
+	ExactDecimal       bool               `json:"exactDecimal"`
+	SpatialFormat      string             `json:"spatialFormat"`
+	ParseJson          bool               `json:"parseJson"`
+	JsonPaths          []*JsonPathMapping `json:"jsonPaths"`
+	TypeMap            map[string]string  `json:"typeMap"`
+}
+
+// JsonPathMapping lifts a value out of a JSON column into a property or reference of its own.
+type JsonPathMapping struct {
+	Path              string `json:"path"`
 	PropertyName      string `json:"propertyName"`
-	IsIdColumn        bool   `json:"isIdColumn"`
 	IsReference       bool   `json:"isReference"`
 	ReferenceTemplate string `json:"referenceTemplate"`
-	IgnoreColumn      bool   `json:"ignoreColumn"`
 }
 
 type PostMapping struct {
@@ -56,6 +131,7 @@ type PostMapping struct {
 	TimeZone              string          `json:"timezone"`
 	BatchSize             int             `json:"batchSize"`
 	Workers               int             `json:"workers"`
+	EntityIdConstructor   string          `json:"entityIdConstructor"`
 }
 
 type FieldMapping struct {
@@ -63,6 +139,7 @@ type FieldMapping struct {
 	SortOrder        int    `json:"order"`
 	ResolveNamespace bool   `json:"resolveNamespace"`
 	DataType         string `json:"dataType"`
+	Srid             int    `json:"srid"`
 }
 
 type TableConfig struct {
@@ -190,6 +267,113 @@ func (layer *Datalayer) GetPostUrl(table *PostMapping) *url.URL {
 	return u
 }
 
+// Dataset returns the name the table mapping is exposed as, the table name if no dataset name is set.
+func (table *TableMapping) Dataset() string {
+	if table.DatasetName != "" {
+		return table.DatasetName
+	}
+	return table.TableName
+}
+
+// Dataset returns the name the post mapping is exposed as, the table name if no dataset name is set.
+func (post *PostMapping) Dataset() string {
+	if post.DatasetName != "" {
+		return post.DatasetName
+	}
+	return post.TableName
+}
+
+// DuplicateDatasets returns the dataset names used by more than one table mapping. Validate
+// rejects a configuration that has any.
+func (layer *Datalayer) DuplicateDatasets() []string {
+	seen := make(map[string]bool)
+	var duplicates []string
+	for _, table := range layer.TableMappings {
+		name := table.Dataset()
+		if seen[name] && !slices.Contains(duplicates, name) {
+			duplicates = append(duplicates, name)
+		}
+		seen[name] = true
+	}
+	return duplicates
+}
+
+// IdColumn returns the name of the column mapped as the entity id, or "" if none or several
+// are mapped.
+func (table *TableMapping) IdColumn() string {
+	columns := table.IdColumns()
+	if len(columns) != 1 {
+		return ""
+	}
+	return columns[0]
+}
+
+// IdColumns returns the names of the columns mapped as the entity id, the primary key of the table.
+func (table *TableMapping) IdColumns() []string {
+	var columns []string
+	for _, cm := range table.ColumnMappings {
+		if cm.IsIdColumn {
+			columns = append(columns, cm.FieldName)
+		}
+	}
+	return columns
+}
+
+// EntityIdPlaceholder matches a named key column in an entity id constructor, "{Column}".
+var EntityIdPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// KeyColumns returns the key columns named in an entity id constructor, in the order they
+// appear, or nil if the constructor is a plain format string for a single id column.
+func KeyColumns(constructor string) []string {
+	var columns []string
+	for _, match := range EntityIdPlaceholder.FindAllStringSubmatch(constructor, -1) {
+		columns = append(columns, match[1])
+	}
+	return columns
+}
+
+// PropertyColumn returns the column a property is read from, by the field name, the property
+// name, or the property name without its namespace prefix, of a column mapping. Only mapped
+// columns are found.
+func (table *TableMapping) PropertyColumn(name string) string {
+	for _, cm := range table.ColumnMappings {
+		if cm.FieldName == name || (cm.PropertyName != "" && (cm.PropertyName == name || cm.PropertyName == "ns0:"+name)) {
+			return cm.FieldName
+		}
+	}
+	return ""
+}
+
+// ExactDecimal reports whether the decimal and money values of a column are returned as exact
+// decimal strings, for the whole table or for just this column.
+func (table *TableMapping) ExactDecimal(column string) bool {
+	if table.ExactDecimals {
+		return true
+	}
+	for _, cm := range table.ColumnMappings {
+		if cm.FieldName == column {
+			return cm.ExactDecimal
+		}
+	}
+	return false
+}
+
+// softDeleteFlagTypes are the types of a soft delete column that mark a row deleted without a
+// softDeleteValue, when the bit is set or the time is.
+var softDeleteFlagTypes = []string{"bit", "date", "datetime", "datetime2", "smalldatetime", "datetimeoffset", "time"}
+
+// ValidateSoftDelete checks the soft delete column of a table mapping against its data type. A
+// column that is not a bit or a time needs a softDeleteValue, as no other value can tell a
+// deleted row from a live one: 0, 'N' and an empty string would all mark it deleted. A column
+// of unknown type is not checked.
+func (table *TableMapping) ValidateSoftDelete(columnType string) error {
+	columnType = strings.ToLower(columnType)
+	if table.SoftDeleteColumn == "" || table.SoftDeleteValue != "" || columnType == "" || slices.Contains(softDeleteFlagTypes, columnType) {
+		return nil
+	}
+	return fmt.Errorf("table mapping %s: soft delete column %s is a %s and needs a softDeleteValue", table.Dataset(), table.SoftDeleteColumn, columnType)
+}
+
 func (layer *Datalayer) GetSchema(table *TableMapping) string {
 	schema := layer.Schema
 	if table.Config != nil {
@@ -199,3 +383,44 @@ func (layer *Datalayer) GetSchema(table *TableMapping) string {
 	}
 	return schema
 }
+
+// TableMapping returns the mapping the rows of an embedded entity are read with. It shares the
+// connection, namespace and time zone of the parent table.
+func (e *EmbeddedEntity) TableMapping(parent *TableMapping) *TableMapping {
+	columns := make(map[string]*ColumnMapping)
+	for _, cm := range e.ColumnMappings {
+		columns[cm.FieldName] = cm
+	}
+	return &TableMapping{
+		TableName:           e.TableName,
+		NameSpace:           parent.NameSpace,
+		CaptureInstance:     e.CaptureInstance,
+		SinceColumn:         e.SinceColumn,
+		EntityIdConstructor: e.EntityIdConstructor,
+		Types:               e.Types,
+		ColumnMappings:      e.ColumnMappings,
+		Config:              parent.Config,
+		TimeZone:            parent.TimeZone,
+		ExactDecimals:       parent.ExactDecimals,
+		Columns:             columns,
+	}
+}
+
+// QueryParams returns the request query parameters the arguments of a procedure are bound from.
+func (p *ProcedureMapping) QueryParams() []string {
+	var params []string
+	for _, arg := range p.Arguments {
+		if arg.Source == "query" {
+			params = append(params, arg.Param())
+		}
+	}
+	return params
+}
+
+// Param returns the query parameter an argument is bound from.
+func (a *ProcedureArgument) Param() string {
+	if a.QueryParam != "" {
+		return a.QueryParam
+	}
+	return a.Name
+}
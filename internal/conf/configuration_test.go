@@ -144,3 +144,77 @@ func TestParseConfig(t *testing.T) {
 		})
 	})
 }
+
+func TestParseQueryTemplate(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	g.Describe("when parsing a query template", func() {
+		g.It("should read the placeholders and their types", func() {
+			template, err := ParseQueryTemplate("SELECT TOP ({{ limit }}) * FROM Orders WHERE Region = {{param.region}} AND Amount > {{ param.min:float }} AND Tenant = {{ env.TENANT }}")
+			g.Assert(err).IsNil()
+			g.Assert(len(template.Placeholders)).Equal(4)
+			g.Assert(*template.Placeholders[0]).Equal(Placeholder{Text: "{{ limit }}", Source: "limit"})
+			g.Assert(*template.Placeholders[2]).Equal(Placeholder{Text: "{{ param.min:float }}", Source: "param", Name: "min", Type: "float"})
+			g.Assert(template.Params()).Equal([]string{"region", "min"})
+			g.Assert(template.Uses("env")).IsTrue()
+			g.Assert(template.Uses("since")).IsFalse()
+		})
+		g.It("should read the type of a since placeholder", func() {
+			template, err := ParseQueryTemplate("SELECT * FROM Orders WHERE Changed > {{ since:datetime2 }}")
+			g.Assert(err).IsNil()
+			g.Assert(*template.Placeholders[0]).Equal(Placeholder{Text: "{{ since:datetime2 }}", Source: "since", Type: "datetime2"})
+		})
+		g.It("should reject bad templates", func() {
+			for _, query := range []string{
+				"SELECT * FROM Orders WHERE Changed > {{ since }",
+				"SELECT * FROM Orders WHERE Changed > {{ until }}",
+				"SELECT * FROM Orders WHERE Region = {{ param. }}",
+				"SELECT * FROM Orders WHERE Region = {{ param.region:money }}",
+				"SELECT TOP ({{ limit:int }}) * FROM Orders",
+				"SELECT * FROM Orders WHERE Changed > {{ since:date }}",
+			} {
+				_, err := ParseQueryTemplate(query)
+				g.Assert(err == nil).IsFalse(query)
+			}
+		})
+		g.It("should reject a configuration with a bad template when it is loaded", func() {
+			layer := &Datalayer{TableMappings: []*TableMapping{
+				{TableName: "Orders", CustomQuery: "SELECT %s * FROM Orders"},
+				{TableName: "Lines", CustomQuery: "SELECT * FROM Lines WHERE Changed > {{ snice }}"},
+			}}
+			g.Assert(layer.Validate() == nil).IsFalse()
+			layer.TableMappings = layer.TableMappings[:1]
+			g.Assert(layer.Validate()).IsNil()
+		})
+		g.It("should reject a procedure argument that is not a parameter name", func() {
+			layer := &Datalayer{TableMappings: []*TableMapping{
+				{TableName: "Orders", Procedure: &ProcedureMapping{Arguments: []*ProcedureArgument{{Name: "@Region"}}}},
+			}}
+			g.Assert(layer.Validate()).IsNil()
+			layer.TableMappings[0].Procedure.Arguments[0].Name = "Region = 1; DROP TABLE Orders; --"
+			g.Assert(layer.Validate() == nil).IsFalse()
+		})
+		g.It("should need a softDeleteValue for a soft delete column that is not a bit or a time", func() {
+			table := &TableMapping{TableName: "Customers", SoftDeleteColumn: "Deleted"}
+			g.Assert(table.ValidateSoftDelete("bit")).IsNil()
+			g.Assert(table.ValidateSoftDelete("DATETIME2")).IsNil()
+			for _, columnType := range []string{"int", "CHAR", "float", "nvarchar"} {
+				g.Assert(table.ValidateSoftDelete(columnType) == nil).IsFalse(columnType)
+			}
+			table.SoftDeleteValue = "Y"
+			g.Assert(table.ValidateSoftDelete("char")).IsNil()
+
+			layer := &Datalayer{TableMappings: []*TableMapping{{TableName: "Customers", SoftDeleteValue: "Y"}}}
+			g.Assert(layer.Validate() == nil).IsFalse()
+		})
+		g.It("should reject a configuration with a dataset defined twice", func() {
+			layer := &Datalayer{TableMappings: []*TableMapping{
+				{TableName: "Customers"},
+				{TableName: "Customers", CustomQuery: "SELECT * FROM Customers WHERE Country = 'NO'"},
+			}}
+			g.Assert(layer.Validate() == nil).IsFalse()
+			layer.TableMappings[1].DatasetName = "CustomersNorway"
+			g.Assert(layer.Validate()).IsNil()
+		})
+	})
+}
@@ -123,6 +123,10 @@ func (conf *ConfigurationManager) load() {
 			conf.logger.Warnf("Unable to parse json into config. Error is: %v. Please check file: %v", err.Error(), conf.configLocation)
 			return
 		}
+		if err := config.Validate(); err != nil {
+			conf.logger.Warnf("Invalid configuration, keeping the one loaded before. Error is: %v. Please check file: %v", err.Error(), conf.configLocation)
+			return
+		}
 
 		conf.Datalayer = conf.mapColumns(conf.setUser(config))
 		conf.State = state
@@ -0,0 +1,166 @@
+package conf
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// ArgumentTypes are the types a procedure argument, or a query template placeholder, can be
+// converted to. The empty type is a string.
+var ArgumentTypes = []string{"", "string", "int", "float", "bool", "datetime", "date"}
+
+// SinceTypes are the data types a {{ since }} placeholder can be compared as, the type of the
+// column it is compared to. The empty type is a datetime.
+var SinceTypes = []string{"", "datetime", "datetime2", "smalldatetime", "datetimeoffset"}
+
+// Placeholder is a named value in a query template, like {{ limit }}, {{ since:datetime2 }},
+// {{ param.region }} or {{ env.TENANT:int }}.
+type Placeholder struct {
+	Text   string // the placeholder as written in the query
+	Source string // limit, offset, since, param or env
+	Name   string // the name of a param or env placeholder
+	Type   string // the type of a param, env or since placeholder
+}
+
+// QueryTemplate is a custom query with its placeholders. Each placeholder is replaced with a
+// bound parameter when the query is run.
+type QueryTemplate struct {
+	Query        string
+	Placeholders []*Placeholder
+}
+
+var (
+	placeholderPattern = regexp.MustCompile(`\{\{(.*?)\}\}`)
+	placeholderName    = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// IsTemplate reports whether a custom query uses placeholders. Queries without them are read
+// the old way, with a %s the TOP clause of the limit is put in.
+func IsTemplate(query string) bool {
+	return strings.Contains(query, "{{")
+}
+
+// ParseQueryTemplate reads the placeholders of a custom query. A placeholder that is not closed,
+// has an unknown source or type, or a name that is not an identifier, is an error.
+func ParseQueryTemplate(query string) (*QueryTemplate, error) {
+	template := &QueryTemplate{Query: query}
+	rest := placeholderPattern.ReplaceAllString(query, "")
+	if strings.Contains(rest, "{{") || strings.Contains(rest, "}}") {
+		return nil, fmt.Errorf("unbalanced {{ }} in query %q", query)
+	}
+	for _, match := range placeholderPattern.FindAllStringSubmatch(query, -1) {
+		p := &Placeholder{Text: match[0]}
+		expr := strings.TrimSpace(match[1])
+		expr, p.Type, _ = strings.Cut(expr, ":")
+		p.Source, p.Name, _ = strings.Cut(strings.TrimSpace(expr), ".")
+		p.Type = strings.TrimSpace(p.Type)
+
+		switch p.Source {
+		case "limit", "offset":
+			if p.Name != "" || p.Type != "" {
+				return nil, fmt.Errorf("placeholder %s takes no name or type", p.Text)
+			}
+		case "since":
+			if p.Name != "" {
+				return nil, fmt.Errorf("placeholder %s takes no name", p.Text)
+			}
+			if !slices.Contains(SinceTypes, p.Type) {
+				return nil, fmt.Errorf("placeholder %s has unknown type %s", p.Text, p.Type)
+			}
+		case "param", "env":
+			if !placeholderName.MatchString(p.Name) {
+				return nil, fmt.Errorf("placeholder %s needs a name", p.Text)
+			}
+			if !slices.Contains(ArgumentTypes, p.Type) {
+				return nil, fmt.Errorf("placeholder %s has unknown type %s", p.Text, p.Type)
+			}
+		default:
+			return nil, fmt.Errorf("unknown placeholder %s", p.Text)
+		}
+		template.Placeholders = append(template.Placeholders, p)
+	}
+	return template, nil
+}
+
+// Uses reports whether the template has a placeholder of a source.
+func (t *QueryTemplate) Uses(source string) bool {
+	return slices.ContainsFunc(t.Placeholders, func(p *Placeholder) bool {
+		return p.Source == source
+	})
+}
+
+// Params returns the names of the request query parameters the template is bound from.
+func (t *QueryTemplate) Params() []string {
+	var params []string
+	for _, p := range t.Placeholders {
+		if p.Source == "param" && !slices.Contains(params, p.Name) {
+			params = append(params, p.Name)
+		}
+	}
+	return params
+}
+
+// Validate checks the dataset names, custom queries, soft delete settings and procedure
+// arguments of the table mappings, so a configuration that can not be read is rejected when it
+// is loaded. The type of a soft delete column is only known once the database is connected to,
+// see TableMapping.ValidateSoftDelete.
+func (layer *Datalayer) Validate() error {
+	if duplicates := layer.DuplicateDatasets(); len(duplicates) > 0 {
+		return fmt.Errorf("datasets %s are defined by more than one table mapping, give them each a datasetName", strings.Join(duplicates, ", "))
+	}
+	for _, table := range layer.TableMappings {
+		if IsTemplate(table.CustomQuery) {
+			if _, err := ParseQueryTemplate(table.CustomQuery); err != nil {
+				return fmt.Errorf("table mapping %s: %w", table.Dataset(), err)
+			}
+		}
+		if table.SoftDeleteValue != "" && table.SoftDeleteColumn == "" {
+			return fmt.Errorf("table mapping %s: softDeleteValue is set without a softDeleteColumn", table.Dataset())
+		}
+		if table.Procedure == nil {
+			continue
+		}
+		if name := strings.TrimPrefix(table.Procedure.SinceParameter, "@"); name != "" && !placeholderName.MatchString(name) {
+			return fmt.Errorf("table mapping %s: since parameter %s is not a parameter name", table.Dataset(), table.Procedure.SinceParameter)
+		}
+		for _, arg := range table.Procedure.Arguments {
+			if !placeholderName.MatchString(strings.TrimPrefix(arg.Name, "@")) {
+				return fmt.Errorf("table mapping %s: argument %s is not a parameter name", table.Dataset(), arg.Name)
+			}
+			if !slices.Contains(ArgumentTypes, arg.Type) {
+				return fmt.Errorf("table mapping %s: argument %s has unknown type %s", table.Dataset(), arg.Name, arg.Type)
+			}
+			if !slices.Contains([]string{"", "config", "since", "limit", "query"}, arg.Source) {
+				return fmt.Errorf("table mapping %s: argument %s has unknown source %s", table.Dataset(), arg.Name, arg.Source)
+			}
+		}
+	}
+	return nil
+}
+
+// QueryParams returns the request query parameters a table mapping passes on to its procedure
+// or query template. They are not read as filters.
+func (table *TableMapping) QueryParams() []string {
+	if table.Procedure != nil {
+		return table.Procedure.QueryParams()
+	}
+	if template := table.Template(); template != nil {
+		return template.Params()
+	}
+	return nil
+}
+
+// Template returns the query template of a table mapping, or nil if it has no custom query with
+// placeholders. Templates are checked when the configuration is loaded.
+func (table *TableMapping) Template() *QueryTemplate {
+	if !IsTemplate(table.CustomQuery) {
+		return nil
+	}
+	template, err := ParseQueryTemplate(table.CustomQuery)
+	if err != nil {
+		return nil
+	}
+	return template
+}
@@ -0,0 +1,152 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// CatalogColumn is a column of a table, as described by the sys catalog views.
+type CatalogColumn struct {
+	Schema         string
+	Table          string
+	Name           string
+	Type           string // as in sys.types, rowversion columns are timestamp
+	MaxLength      int    // in bytes, -1 for max
+	Precision      int
+	Scale          int
+	Nullable       bool
+	PrimaryKey     bool
+	Identity       bool
+	Computed       bool
+	CDCEnabled     bool // of the table
+	ChangeTracking bool // of the table
+}
+
+// DataType returns the column type the way it is declared, like NVARCHAR(100) or DECIMAL(10,2).
+func (c *CatalogColumn) DataType() string {
+	name := strings.ToUpper(c.Type)
+	switch name {
+	case "VARCHAR", "CHAR", "VARBINARY", "BINARY":
+		if c.MaxLength < 0 {
+			return name + "(MAX)"
+		}
+		return fmt.Sprintf("%s(%d)", name, c.MaxLength)
+	case "NVARCHAR", "NCHAR":
+		// the length is in bytes, two to a character
+		if c.MaxLength < 0 {
+			return name + "(MAX)"
+		}
+		return fmt.Sprintf("%s(%d)", name, c.MaxLength/2)
+	case "DECIMAL", "NUMERIC":
+		return fmt.Sprintf("%s(%d,%d)", name, c.Precision, c.Scale)
+	default:
+		return name
+	}
+}
+
+// catalogQuery lists the columns of the user tables of a set of schemas, in table and column order.
+const catalogQuery = `
+		SELECT s.name, t.name, c.name, ty.name, c.max_length, c.precision, c.scale,
+			c.is_nullable, c.is_identity, c.is_computed, t.is_tracked_by_cdc,
+			CAST(CASE WHEN EXISTS (
+				SELECT 1 FROM sys.index_columns AS ic
+				JOIN sys.indexes AS i ON i.object_id = ic.object_id AND i.index_id = ic.index_id
+				WHERE i.is_primary_key = 1 AND ic.object_id = c.object_id AND ic.column_id = c.column_id
+			) THEN 1 ELSE 0 END AS bit),
+			CAST(CASE WHEN EXISTS (
+				SELECT 1 FROM sys.change_tracking_tables AS ct WHERE ct.object_id = t.object_id
+			) THEN 1 ELSE 0 END AS bit)
+		FROM sys.columns AS c
+		JOIN sys.tables AS t ON t.object_id = c.object_id
+		JOIN sys.schemas AS s ON s.schema_id = t.schema_id
+		JOIN sys.types AS ty ON ty.user_type_id = c.user_type_id
+		WHERE t.is_ms_shipped = 0 AND s.name IN (%s)%s
+		ORDER BY s.name, t.name, c.column_id`
+
+// Catalog reads the columns of the tables in a set of schemas, or of just the named tables in them.
+func Catalog(sqlDB *sql.DB, schemas []string, tables []string) ([]*CatalogColumn, error) {
+	if len(schemas) == 0 {
+		return nil, fmt.Errorf("no schemas to read")
+	}
+	args := params{}
+	schemaList := make([]string, len(schemas))
+	for i, schema := range schemas {
+		schemaList[i] = args.add(schema)
+	}
+	tableFilter := ""
+	if len(tables) > 0 {
+		tableList := make([]string, len(tables))
+		for i, table := range tables {
+			tableList[i] = args.add(table)
+		}
+		tableFilter = fmt.Sprintf(" AND t.name IN (%s)", strings.Join(tableList, ", "))
+	}
+
+	rows, err := sqlDB.Query(fmt.Sprintf(catalogQuery, strings.Join(schemaList, ", "), tableFilter), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	columns := make([]*CatalogColumn, 0)
+	for rows.Next() {
+		c := &CatalogColumn{}
+		var maxLength, precision, scale int64
+		if err := rows.Scan(&c.Schema, &c.Table, &c.Name, &c.Type, &maxLength, &precision, &scale,
+			&c.Nullable, &c.Identity, &c.Computed, &c.CDCEnabled, &c.PrimaryKey, &c.ChangeTracking); err != nil {
+			return nil, err
+		}
+		c.MaxLength, c.Precision, c.Scale = int(maxLength), int(precision), int(scale)
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+// ColumnType returns the data type of a column of a table, as named in sys.types, or "" if the
+// table has no such column.
+func ColumnType(sqlDB *sql.DB, schema string, table string, column string) (string, error) {
+	var name sql.NullString
+	row := sqlDB.QueryRow("SELECT TYPE_NAME(system_type_id) FROM sys.columns WHERE object_id = OBJECT_ID(@p1) AND name = @p2", TableName(schema, table), column)
+	if err := row.Scan(&name); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return name.String, nil
+}
+
+// ResultColumn is a column of the result set of a statement.
+type ResultColumn struct {
+	Name     string
+	Type     string // as in sys.types, without its length, like NVARCHAR
+	Nullable bool
+}
+
+// DescribeResultSet returns the columns of the first result set of a statement, as SQL Server
+// works them out without running it.
+func DescribeResultSet(sqlDB *sql.DB, statement string) ([]*ResultColumn, error) {
+	rows, err := sqlDB.Query("SELECT name, system_type_name, is_nullable, error_message FROM sys.dm_exec_describe_first_result_set(@p1, NULL, 0) "+
+		"WHERE is_hidden = 0 OR is_hidden IS NULL ORDER BY column_ordinal", statement)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	columns := make([]*ResultColumn, 0)
+	for rows.Next() {
+		var name, typeName, message sql.NullString
+		var nullable sql.NullBool
+		if err := rows.Scan(&name, &typeName, &nullable, &message); err != nil {
+			return nil, err
+		}
+		if message.Valid {
+			return nil, fmt.Errorf("could not describe the result of %s: %s", statement, message.String)
+		}
+		typeName.String, _, _ = strings.Cut(typeName.String, "(")
+		columns = append(columns, &ResultColumn{Name: name.String, Type: strings.ToUpper(typeName.String), Nullable: nullable.Bool})
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,271 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+// CaptureInstance describes the change table a CDC read goes through, as registered in
+// cdc.change_tables. It is resolved by the layer and handed to the query with the request.
+type CaptureInstance struct {
+	Name               string
+	SupportsNetChanges bool
+	StartLsn           []byte   // lowest lsn the change table can be read from
+	Columns            []string // captured columns, nil if not known
+}
+
+// ParseColumnList reads the captured_column_list of cdc.change_tables, the quoted names of the
+// captured columns separated by commas, like "[Id], [Name]".
+func ParseColumnList(list string) []string {
+	columns := make([]string, 0)
+	for rest := strings.TrimSpace(list); strings.HasPrefix(rest, "["); {
+		name, end := "", -1
+		for i := 1; i < len(rest); i++ {
+			if rest[i] != ']' {
+				continue
+			}
+			if i+1 < len(rest) && rest[i+1] == ']' {
+				i++
+				continue
+			}
+			name, end = strings.ReplaceAll(rest[1:i], "]]", "]"), i
+			break
+		}
+		if end < 0 {
+			break
+		}
+		columns = append(columns, name)
+		rest = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest[end+1:]), ","))
+	}
+	return columns
+}
+
+// CaptureInstanceName is the configured capture instance of a table, or the name SQL Server
+// gives it by default.
+func CaptureInstanceName(tableDef *conf.TableMapping) string {
+	if tableDef.CaptureInstance != "" {
+		return tableDef.CaptureInstance
+	}
+	return fmt.Sprintf("%s_%s", CDCSchema(tableDef), tableDef.TableName)
+}
+
+// CDCSchema is the schema of a cdc enabled table.
+func CDCSchema(tableDef *conf.TableMapping) string {
+	if tableDef.Config != nil && tableDef.Config.Schema != nil {
+		return *tableDef.Config.Schema
+	}
+	return "dbo"
+}
+
+// SelectCaptureInstance picks the capture instance to continue a read from. A table has two
+// capture instances while a DBA rolls out a schema change. Both record every change made after
+// the newer one was created, and lsns are shared by the whole database, so the read moves to the
+// newest instance that reaches back to the token. Until the token gets there, the older one is
+// read. Without a token the configured instance is used. If no instance reaches back to the
+// token, like when the instance it was read from has been dropped, the changes after it are
+// gone and ok is false.
+func SelectCaptureInstance(configured string, instances []*CaptureInstance, since string) (*CaptureInstance, bool) {
+	token, ok := DecodeCDCToken(since)
+	if !ok {
+		for _, ci := range instances {
+			if ci.Name == configured {
+				return ci, true
+			}
+		}
+		return &CaptureInstance{Name: configured}, true
+	}
+
+	// instances are ordered by creation, the newest last
+	var selected *CaptureInstance
+	for _, ci := range instances {
+		if ci.StartLsn != nil && bytes.Compare(ci.StartLsn, token.Lsn) <= 0 {
+			selected = ci
+		}
+	}
+	return selected, selected != nil
+}
+
+var (
+	allChangesRowFilters = []string{"all", "all update old"}
+	netChangesRowFilters = []string{"all", "all with mask", "all with merge"}
+)
+
+type CDCQuery struct {
+	Datalayer *conf.Datalayer
+	Request   DatasetRequest
+	TableDef  *conf.TableMapping
+}
+
+func (q CDCQuery) BuildQuery() (string, []any, error) {
+	capture := q.Request.Capture
+	if capture == nil {
+		capture = &CaptureInstance{Name: CaptureInstanceName(q.TableDef)}
+	}
+
+	// net changes collapse every change to a row in the range into one, but need the capture
+	// instance to be created with @supports_net_changes
+	netChanges := q.TableDef.CDCNetChanges && capture.SupportsNetChanges
+	function := "fn_cdc_get_all_changes_" + capture.Name
+	rowFilters := allChangesRowFilters
+	if netChanges {
+		function = "fn_cdc_get_net_changes_" + capture.Name
+		rowFilters = netChangesRowFilters
+	}
+	rowFilter := "all"
+	if q.TableDef.CDCRowFilter != "" {
+		if slices.Contains(rowFilters, q.TableDef.CDCRowFilter) {
+			rowFilter = q.TableDef.CDCRowFilter
+		} else if netChanges || !q.TableDef.CDCNetChanges {
+			// a net changes filter is only dropped when falling back to all changes
+			return "", nil, fmt.Errorf("row filter %q is not one of %q", q.TableDef.CDCRowFilter, rowFilters)
+		}
+	}
+
+	args := params{}
+
+	// fall back to the start of the capture instance if the token is not a valid lsn
+	lastLsn := fmt.Sprintf("sys.fn_cdc_get_min_lsn(%s)", args.add(capture.Name))
+	fromLsn := "sys.fn_cdc_increment_lsn(@last_lsn)"
+	predicates := make([]string, 0, 2)
+	token, ok := DecodeCDCToken(q.Request.Since)
+	if ok {
+		lastLsn = args.add(token.Lsn)
+		if token.Seqval != nil && netChanges {
+			// net changes have no seqval to continue from, so read the whole lsn again
+			fromLsn = "@last_lsn"
+		} else if token.Seqval != nil {
+			// the previous read stopped inside this lsn, so continue after the last row it emitted
+			fromLsn = "@last_lsn"
+			predicates = append(predicates, fmt.Sprintf("([__$start_lsn] > @last_lsn OR ([__$start_lsn] = @last_lsn AND [__$seqval] > %s))", args.add(token.Seqval)))
+		}
+	}
+
+	// the read is bounded by the lsn the continuation token was taken from, so nothing
+	// committed while the rows are streamed can slip past the token
+	toLsn := "sys.fn_cdc_get_max_lsn()"
+	if until, ok := DecodeCDCToken(q.Request.Until); ok {
+		toLsn = args.add(until.Lsn)
+	}
+
+	// a page never ends inside the rows of one change: with ties keeps an update old/new pair
+	// together, and all net changes of an lsn
+	orderBy := "[__$start_lsn], [__$seqval]"
+	if netChanges {
+		orderBy = "[__$start_lsn]"
+	}
+	limit := ""
+	if q.Request.Limit > 0 {
+		limit = fmt.Sprintf("TOP (%s) WITH TIES ", args.add(q.Request.Limit))
+	}
+	filter := args.add(rowFilter)
+	// the change columns are read whatever fields are asked for
+	changeColumns := []string{"__$start_lsn", "__$seqval", "__$operation", "__$update_mask"}
+	if netChanges {
+		changeColumns = []string{"__$start_lsn", "__$operation", "__$update_mask"}
+	}
+	// the change function returns the captured columns only, so only those can be listed
+	request := q.Request
+	request.Columns = capturedColumns(request.Columns, capture)
+	columns, alias, err := RequestColumns(request, q.TableDef, q.Datalayer, changeColumns...)
+	if err != nil {
+		return "", nil, err
+	}
+	filters, err := filterPredicates(q.Request, q.TableDef, &args, columnPrefix(alias))
+	if err != nil {
+		return "", nil, err
+	}
+	if filters != "" {
+		predicates = append(predicates, filters)
+	}
+
+	query := fmt.Sprintf(`
+		DECLARE @from_lsn binary(10), @to_lsn binary(10), @last_lsn binary(10);
+		SET @last_lsn = %s;
+		SET @from_lsn = %s;
+		SET @to_lsn = %s;
+		SELECT %s%s from cdc.%s ( @from_lsn, @to_lsn, %s )%s%s ORDER BY %s;
+`, lastLsn, fromLsn, toLsn, limit, columns, QuoteName(function), filter, alias, whereClause(predicates), orderBy)
+	return query, args, nil
+}
+
+func capturedColumns(columns []*CatalogColumn, capture *CaptureInstance) []*CatalogColumn {
+	if capture.Columns == nil {
+		return nil
+	}
+	captured := make([]*CatalogColumn, 0, len(columns))
+	for _, column := range columns {
+		if slices.Contains(capture.Columns, column.Name) {
+			captured = append(captured, column)
+		}
+	}
+	return captured
+}
+
+// CDCToken is the position in a change table a CDC read continues from. A token without
+// a seqval covers every change in its lsn, a token with one stops after that row.
+type CDCToken struct {
+	Lsn    []byte
+	Seqval []byte
+}
+
+// Expired reports whether the changes after the token have been partly purged from a change
+// table that can only be read from minLsn. A zero minLsn means the capture instance is unknown.
+func (t CDCToken) Expired(minLsn []byte) bool {
+	if len(minLsn) == 0 || bytes.Count(minLsn, []byte{0}) == len(minLsn) {
+		return false
+	}
+	return bytes.Compare(t.Lsn, minLsn) < 0
+}
+
+// Encode returns the url safe base64 encoding of the hex literals of the token, "0x<lsn>"
+// or "0x<lsn>:0x<seqval>".
+func (t CDCToken) Encode() string {
+	s := fmt.Sprintf("0x%x", t.Lsn)
+	if t.Seqval != nil {
+		s += fmt.Sprintf(":0x%x", t.Seqval)
+	}
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// DecodeCDCToken reads a token created by Encode.
+func DecodeCDCToken(token string) (CDCToken, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return CDCToken{}, false
+	}
+	parts := strings.Split(string(data), ":")
+	if len(parts) > 2 {
+		return CDCToken{}, false
+	}
+	lsn, ok := decodeBinary(parts[0], 10)
+	if !ok {
+		return CDCToken{}, false
+	}
+	t := CDCToken{Lsn: lsn}
+	if len(parts) == 2 {
+		seqval, ok := decodeBinary(parts[1], 10)
+		if !ok {
+			return CDCToken{}, false
+		}
+		t.Seqval = seqval
+	}
+	return t, true
+}
+
+// decodeBinary reads the hex literal of a binary(size) value, "0x" followed by 2*size hex digits.
+func decodeBinary(literal string, size int) ([]byte, bool) {
+	if !strings.HasPrefix(literal, "0x") || len(literal) != 2+2*size {
+		return nil, false
+	}
+	value, err := hex.DecodeString(literal[2:])
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
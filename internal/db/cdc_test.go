@@ -0,0 +1,96 @@
+package db
+
+import (
+	"testing"
+
+	goblin "github.com/franela/goblin"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+func TestSelectCaptureInstance(t *testing.T) {
+	g := goblin.Goblin(t)
+
+	lsn := func(b byte) []byte {
+		return []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, b}
+	}
+	selectName := func(configured string, instances []*CaptureInstance, since string) string {
+		ci, _ := SelectCaptureInstance(configured, instances, since)
+		return ci.Name
+	}
+	instances := []*CaptureInstance{
+		{Name: "dbo_Table1", StartLsn: lsn(0x10)},
+		{Name: "dbo_Table1_v2", StartLsn: lsn(0x40)},
+	}
+
+	g.Describe("when a table has two capture instances", func() {
+		g.It("should keep reading the old instance until the token reaches the new one", func() {
+			since := CDCToken{Lsn: lsn(0x20)}.Encode()
+			g.Assert(selectName("dbo_Table1", instances, since)).Equal("dbo_Table1")
+		})
+
+		g.It("should move to the new instance once the token has reached it", func() {
+			since := CDCToken{Lsn: lsn(0x40), Seqval: lsn(0x41)}.Encode()
+			g.Assert(selectName("dbo_Table1", instances, since)).Equal("dbo_Table1_v2")
+		})
+
+		g.It("should read the old instance for an old token even if the new one is configured", func() {
+			since := CDCToken{Lsn: lsn(0x20)}.Encode()
+			g.Assert(selectName("dbo_Table1_v2", instances, since)).Equal("dbo_Table1")
+		})
+
+		g.It("should use the configured instance without a valid token", func() {
+			g.Assert(selectName("dbo_Table1_v2", instances, "")).Equal("dbo_Table1_v2")
+		})
+
+		g.It("should use the configured instance without a token when none is known", func() {
+			g.Assert(selectName("dbo_Table1", nil, "")).Equal("dbo_Table1")
+		})
+
+		g.It("should expire a token no instance reaches back to", func() {
+			since := CDCToken{Lsn: lsn(0x08)}.Encode()
+			_, ok := SelectCaptureInstance("dbo_Table1", instances, since)
+			g.Assert(ok).IsFalse()
+
+			// the instance the token was read from has been dropped, and the new one starts later
+			since = CDCToken{Lsn: lsn(0x20)}.Encode()
+			_, ok = SelectCaptureInstance("dbo_Table1", instances[1:], since)
+			g.Assert(ok).IsFalse()
+			_, ok = SelectCaptureInstance("dbo_Table1", nil, since)
+			g.Assert(ok).IsFalse()
+		})
+	})
+
+	g.Describe("when the cleanup job has purged changes", func() {
+		g.It("should expire a token older than the change table", func() {
+			g.Assert(CDCToken{Lsn: lsn(0x20)}.Expired(lsn(0x30))).IsTrue()
+		})
+
+		g.It("should keep a token the change table still reaches", func() {
+			g.Assert(CDCToken{Lsn: lsn(0x30)}.Expired(lsn(0x30))).IsFalse()
+			g.Assert(CDCToken{Lsn: lsn(0x40)}.Expired(lsn(0x30))).IsFalse()
+		})
+
+		g.It("should not expire a token for an unknown capture instance", func() {
+			g.Assert(CDCToken{Lsn: lsn(0x20)}.Expired(make([]byte, 10))).IsFalse()
+		})
+	})
+
+	g.Describe("when naming the capture instance", func() {
+		g.It("should prefer the configured name", func() {
+			schema := "sales"
+			table := &conf.TableMapping{TableName: "Table1", Config: &conf.TableConfig{Schema: &schema}}
+			g.Assert(CaptureInstanceName(table)).Equal("sales_Table1")
+
+			table.CaptureInstance = "sales_Table1_v2"
+			g.Assert(CaptureInstanceName(table)).Equal("sales_Table1_v2")
+		})
+	})
+
+	g.Describe("when reading the captured columns", func() {
+		g.It("should unquote the column list", func() {
+			g.Assert(ParseColumnList("[Id], [Name], [Odd]], name]")).Equal([]string{"Id", "Name", "Odd], name"})
+			g.Assert(ParseColumnList("")).Equal([]string{})
+		})
+	})
+}
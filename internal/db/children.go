@@ -0,0 +1,38 @@
+package db
+
+import (
+	"fmt"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+// ChildReferencesColumn is the prefix of the columns child references are read into, followed
+// by the index of the child reference in the table mapping.
+const ChildReferencesColumn = "__$children_"
+
+// TableColumns returns the select list and table alias of a read of a table. Without child
+// references that is every column of the table. With them, the keys of the child rows of each
+// child reference are added as a JSON array, so the children are read in the same query as
+// their parent, and the table is aliased t for the subqueries to refer to.
+func TableColumns(tableDef *conf.TableMapping, datalayer *conf.Datalayer) (string, string) {
+	children := childColumns(tableDef, datalayer)
+	if children == "" {
+		return "*", ""
+	}
+	return "t.*" + children, " AS t"
+}
+
+func childColumns(tableDef *conf.TableMapping, datalayer *conf.Datalayer) string {
+	columns := ""
+	for i, child := range tableDef.ChildReferences {
+		parentColumn := child.ParentColumn
+		if parentColumn == "" {
+			parentColumn = tableDef.IdColumn()
+		}
+		key := QuoteName(child.KeyColumn)
+		columns += fmt.Sprintf(", (SELECT c.%s AS [v] FROM %s AS c WHERE c.%s = t.%s ORDER BY c.%s FOR JSON PATH) AS %s",
+			key, TableName(datalayer.GetSchema(tableDef), child.TableName), QuoteName(child.ForeignKey), QuoteName(parentColumn), key,
+			QuoteName(fmt.Sprintf("%s%d", ChildReferencesColumn, i)))
+	}
+	return columns
+}
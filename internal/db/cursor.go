@@ -0,0 +1,132 @@
+package db
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/golang-sql/civil"
+	mssql "github.com/microsoft/go-mssqldb"
+)
+
+// Cursor is the position of a page of entities: the id column value of the last row read.
+// The column type is kept so the value can be bound back with a matching SQL type, which
+// keeps the keyset predicate on an index seek. For a composite key, More holds the values of
+// the key columns after the first, in key order.
+//
+// Since is the change token taken before the first page was read. It is carried from page to
+// page, and handed out with the last one, so changes made while the pages were read follow.
+type Cursor struct {
+	Type  string    `json:"type"`
+	Value any       `json:"value"`
+	More  []*Cursor `json:"more,omitempty"`
+	Since string    `json:"since,omitempty"`
+}
+
+// NewCursor creates a cursor from a scanned id value. Integers are expected as int64,
+// dates as time.Time, and everything else as its string form.
+func NewCursor(ctName string, value any) *Cursor {
+	if t, ok := value.(time.Time); ok {
+		value = t.Format(time.RFC3339Nano)
+	}
+	return &Cursor{Type: ctName, Value: value}
+}
+
+// NewKeyCursor creates a cursor from the scanned values of the key columns, of the types given.
+func NewKeyCursor(ctNames []string, values []any) *Cursor {
+	cursor := NewCursor(ctNames[0], values[0])
+	for i := 1; i < len(values); i++ {
+		cursor.More = append(cursor.More, NewCursor(ctNames[i], values[i]))
+	}
+	return cursor
+}
+
+// Encode returns the cursor as an url safe continuation token.
+func (c *Cursor) Encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// DecodeCursor reads a continuation token created by Encode.
+func DecodeCursor(token string) (*Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid entities token %q: %w", token, err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	cursor := &Cursor{}
+	if err := decoder.Decode(cursor); err != nil {
+		return nil, fmt.Errorf("invalid entities token %q: %w", token, err)
+	}
+	if cursor.Value == nil {
+		return nil, fmt.Errorf("invalid entities token %q: missing value", token)
+	}
+	for _, more := range cursor.More {
+		if more == nil || more.Value == nil {
+			return nil, fmt.Errorf("invalid entities token %q: missing value", token)
+		}
+	}
+	return cursor, nil
+}
+
+// Args returns the values of all key columns of the cursor as query arguments.
+func (c *Cursor) Args() ([]any, error) {
+	arg, err := c.Arg()
+	if err != nil {
+		return nil, err
+	}
+	args := []any{arg}
+	for _, more := range c.More {
+		arg, err := more.Arg()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	return args, nil
+}
+
+// Arg returns the cursor value as a query argument.
+func (c *Cursor) Arg() (any, error) {
+	switch c.Type {
+	case "INT", "SMALLINT", "TINYINT", "BIGINT":
+		n, ok := c.Value.(json.Number)
+		if !ok {
+			return nil, fmt.Errorf("cursor value %v is not a number", c.Value)
+		}
+		return n.Int64()
+	}
+
+	s, ok := c.Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("cursor value %v is not a string", c.Value)
+	}
+	switch c.Type {
+	case "VARCHAR", "CHAR", "TEXT":
+		// an nvarchar argument would force a conversion of every varchar key in the index
+		return mssql.VarChar(s), nil
+	case "DATETIME":
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return mssql.DateTime1(t), nil
+	case "DATETIME2":
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return civil.DateTimeOf(t), nil
+	case "DATE":
+		t, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil {
+			return nil, err
+		}
+		return civil.DateOf(t), nil
+	default:
+		return s, nil
+	}
+}
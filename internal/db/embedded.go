@@ -0,0 +1,109 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+// KeyedQuery reads the rows of a table with a value of Column in Keys. It reads the embedded
+// entities of a batch of parents, and the parents of changed embedded entities.
+type KeyedQuery struct {
+	Datalayer *conf.Datalayer
+	TableDef  *conf.TableMapping
+	Column    string
+	Keys      []any
+	Request   DatasetRequest // the filters and fields of the read the rows are part of
+}
+
+func (q KeyedQuery) BuildQuery() (string, []any, error) {
+	if len(q.Keys) == 0 {
+		return "", nil, fmt.Errorf("no keys to read %s by", q.TableDef.TableName)
+	}
+	tableName := TableName(q.Datalayer.GetSchema(q.TableDef), q.TableDef.TableName)
+
+	args := params{}
+	placeholders := make([]string, len(q.Keys))
+	for i, key := range q.Keys {
+		placeholders[i] = args.add(key)
+	}
+	columns, alias, err := RequestColumns(q.Request, q.TableDef, q.Datalayer, q.Column)
+	if err != nil {
+		return "", nil, err
+	}
+	predicates := []string{fmt.Sprintf("%s%s IN (%s)", columnPrefix(alias), QuoteName(q.Column), strings.Join(placeholders, ", "))}
+	filters, err := filterPredicates(q.Request, q.TableDef, &args, columnPrefix(alias))
+	if err != nil {
+		return "", nil, err
+	}
+	if filters != "" {
+		predicates = append(predicates, filters)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s%s%s", columns, tableName, alias, whereClause(predicates))
+	return query, args, nil
+}
+
+// EmbeddedChangesQuery returns the foreign keys of the embedded entities that changed in the
+// range of a change read of their parents, so the parents can be emitted again. A since column
+// read returns the highest since value of each parent as well, a cdc read returns null for it.
+//
+// The range starts at the since token of the request. It ends at the Until token, which is the
+// last row of the parents read, or the end of the change set if the read was not cut short.
+type EmbeddedChangesQuery struct {
+	Datalayer *conf.Datalayer
+	Request   DatasetRequest
+	TableDef  *conf.TableMapping
+	Embedded  *conf.EmbeddedEntity
+	SinceType string // data type of the since column of the embedded entity
+}
+
+func (q EmbeddedChangesQuery) BuildQuery() (string, []any, error) {
+	child := q.Embedded.TableMapping(q.TableDef)
+	foreignKey := QuoteName(q.Embedded.ForeignKey)
+
+	args := params{}
+	if q.Embedded.SinceColumn != "" {
+		since, err := DecodeSince(q.Request.Since)
+		if err != nil {
+			return "", nil, err
+		}
+		column := QuoteName(q.Embedded.SinceColumn)
+		where := fmt.Sprintf("%s > %s", column, sinceValue(&args, since, q.SinceType))
+		if q.Request.Until != "" {
+			until, err := DecodeSince(q.Request.Until)
+			if err != nil {
+				return "", nil, err
+			}
+			where += fmt.Sprintf(" AND %s <= %s", column, sinceValue(&args, until, q.SinceType))
+		}
+		query := fmt.Sprintf("SELECT %s, MAX(%s) FROM %s WHERE %s GROUP BY %s",
+			foreignKey, column, TableName(q.Datalayer.GetSchema(child), child.TableName), where, foreignKey)
+		return query, args, nil
+	}
+
+	if q.Embedded.CDCEnabled {
+		since, ok := DecodeCDCToken(q.Request.Since)
+		if !ok {
+			return "", nil, fmt.Errorf("invalid cdc token %q", q.Request.Since)
+		}
+		until, ok := DecodeCDCToken(q.Request.Until)
+		if !ok {
+			return "", nil, fmt.Errorf("invalid cdc token %q", q.Request.Until)
+		}
+		// the changes of the lsn of the token were read with the page that ended in it, and an
+		// empty range reads nothing. a token older than the child change table is rejected before
+		// this is run, as the changes it lacks would leave parents out of the read
+		capture := CaptureInstanceName(child)
+		query := fmt.Sprintf(`
+		DECLARE @from_lsn binary(10), @to_lsn binary(10);
+		SET @from_lsn = sys.fn_cdc_increment_lsn(%s);
+		SET @to_lsn = %s;
+		IF @from_lsn <= @to_lsn
+			SELECT DISTINCT %s, NULL from cdc.%s ( @from_lsn, @to_lsn, N'all' );
+`, args.add(since.Lsn), args.add(until.Lsn), foreignKey, QuoteName("fn_cdc_get_all_changes_"+capture))
+		return query, args, nil
+	}
+
+	return "", nil, fmt.Errorf("embedded entity %s has no since column and is not cdc enabled", child.TableName)
+}
@@ -0,0 +1,200 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+// ErrInvalidRequest is returned when the filters or fields of a request can not be applied to
+// a dataset, like a filter on a property that is not mapped.
+var ErrInvalidRequest = errors.New("invalid request")
+
+// Filter is a predicate on a mapped property of a dataset. Op is one of eq, in, gt, gte, lt
+// or lte, and only an in filter has more than one value.
+type Filter struct {
+	Property string
+	Op       string
+	Values   []string
+}
+
+var filterOperators = map[string]string{
+	"eq":  "=",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+// ParseFilter reads the value of a filter query parameter, the operator and the value separated
+// by a dot: "eq.Oslo", "gte.100" or "in.(NO,SE,DK)".
+func ParseFilter(property string, value string) (Filter, error) {
+	op, operand, ok := strings.Cut(value, ".")
+	if !ok {
+		return Filter{}, fmt.Errorf("%w: filter on %s must be <op>.<value>", ErrInvalidRequest, property)
+	}
+	if op == "in" {
+		operand = strings.TrimSuffix(strings.TrimPrefix(operand, "("), ")")
+		return Filter{Property: property, Op: op, Values: strings.Split(operand, ",")}, nil
+	}
+	if _, ok := filterOperators[op]; !ok {
+		return Filter{}, fmt.Errorf("%w: unknown filter operator %s on %s", ErrInvalidRequest, op, property)
+	}
+	return Filter{Property: property, Op: op, Values: []string{operand}}, nil
+}
+
+// filterPredicates returns the filters of a request as a condition on the columns of a table,
+// with the values bound as parameters, or "" if there are none. The columns are prefixed with
+// the alias of the table, if any.
+func filterPredicates(request DatasetRequest, tableDef *conf.TableMapping, args *params, prefix string) (string, error) {
+	if len(request.Filters) == 0 {
+		return "", nil
+	}
+	if tableDef.CustomQuery != "" {
+		return "", fmt.Errorf("%w: a dataset with a custom query can not be filtered", ErrInvalidRequest)
+	}
+	predicates := make([]string, 0, len(request.Filters))
+	for _, filter := range request.Filters {
+		column := tableDef.PropertyColumn(filter.Property)
+		if column == "" {
+			return "", fmt.Errorf("%w: %s is not a mapped property", ErrInvalidRequest, filter.Property)
+		}
+		column = prefix + QuoteName(column)
+		if filter.Op == "in" {
+			values := make([]string, len(filter.Values))
+			for i, value := range filter.Values {
+				values[i] = args.add(value)
+			}
+			predicates = append(predicates, fmt.Sprintf("%s IN (%s)", column, strings.Join(values, ", ")))
+		} else {
+			predicates = append(predicates, fmt.Sprintf("%s %s %s", column, filterOperators[filter.Op], args.add(filter.Values[0])))
+		}
+	}
+	return strings.Join(predicates, " AND "), nil
+}
+
+// RequestColumns returns the select list and table alias of a read of a table for a request.
+// Without fields, that is what TableColumns returns, unless a column of the table has to be
+// converted, see selectColumn; the columns are then listed. With fields, only the columns of the
+// fields are read, along with the ones the entity ids, embedded entities and continuation tokens
+// are made from, and any extra columns the query needs. The table is then aliased t.
+func RequestColumns(request DatasetRequest, tableDef *conf.TableMapping, datalayer *conf.Datalayer, extra ...string) (string, string, error) {
+	if len(request.Fields) == 0 && !convertsColumns(tableDef, request.Columns) {
+		columns, alias := TableColumns(tableDef, datalayer)
+		return columns, alias, nil
+	}
+	projected, err := projectedColumns(request, tableDef, extra...)
+	if err != nil {
+		return "", "", err
+	}
+	return projected + childColumns(tableDef, datalayer), " AS t", nil
+}
+
+// projectedColumns returns the columns read for the fields of a request, or all the columns of
+// the table if it has none, prefixed with the t alias.
+func projectedColumns(request DatasetRequest, tableDef *conf.TableMapping, extra ...string) (string, error) {
+	if tableDef.CustomQuery != "" {
+		return "", fmt.Errorf("%w: fields can not be selected from a dataset with a custom query", ErrInvalidRequest)
+	}
+	var columns []string
+	if len(request.Fields) == 0 {
+		for _, column := range request.Columns {
+			columns = append(columns, column.Name)
+		}
+	} else {
+		columns = requiredColumns(tableDef)
+	}
+	for _, field := range request.Fields {
+		column := tableDef.PropertyColumn(field)
+		if column == "" {
+			return "", fmt.Errorf("%w: %s is not a mapped property", ErrInvalidRequest, field)
+		}
+		columns = append(columns, column)
+	}
+	columns = append(columns, extra...)
+
+	list := make([]string, 0, len(columns))
+	seen := make(map[string]bool)
+	for _, column := range columns {
+		if column != "" && !seen[column] {
+			seen[column] = true
+			list = append(list, selectColumn(tableDef, request.Columns, column))
+		}
+	}
+	return strings.Join(list, ", "), nil
+}
+
+// selectColumn returns a column of the t alias the way it is read. A hierarchyid is read as its
+// path, like /1/3/, as the binary form means nothing outside SQL Server. A geography or geometry
+// is read as well-known text, or, for a column returned as GeoJSON, with its circular arcs turned
+// into lines, the only curves the serialized form is decoded with.
+//
+// The driver returns an sql_variant holding a decimal, money or uniqueidentifier as bytes, which
+// can not be told from a binary value. These are read by their base type: a uniqueidentifier as
+// its text, and a decimal as a float, or as its text for an exactDecimal column.
+func selectColumn(tableDef *conf.TableMapping, columns []*CatalogColumn, column string) string {
+	name := "t." + QuoteName(column)
+	switch columnType(columns, column) {
+	case "sql_variant":
+		baseType := fmt.Sprintf("SQL_VARIANT_PROPERTY(%s, 'BaseType')", name)
+		decimal := fmt.Sprintf("CAST(%s AS float)", name)
+		money := decimal
+		if tableDef.ExactDecimal(column) {
+			decimal = fmt.Sprintf("CONVERT(varchar(50), %s)", name)
+			money = fmt.Sprintf("CONVERT(varchar(50), CAST(%s AS money), 2)", name)
+		}
+		return fmt.Sprintf("CASE WHEN %s = 'uniqueidentifier' THEN CAST(LOWER(CONVERT(char(36), %s)) AS sql_variant)"+
+			" WHEN %s IN ('decimal', 'numeric') THEN CAST(%s AS sql_variant)"+
+			" WHEN %s IN ('money', 'smallmoney') THEN CAST(%s AS sql_variant)"+
+			" ELSE %s END AS %s", baseType, name, baseType, decimal, baseType, money, name, QuoteName(column))
+	case "hierarchyid":
+		return name + ".ToString() AS " + QuoteName(column)
+	case "geography", "geometry":
+		if colMapping := tableDef.Columns[column]; colMapping != nil && colMapping.SpatialFormat == "geojson" {
+			return name + ".STCurveToLine() AS " + QuoteName(column)
+		}
+		return name + ".STAsText() AS " + QuoteName(column)
+	default:
+		return name
+	}
+}
+
+// convertsColumns reports whether any of the columns is read converted by selectColumn.
+func convertsColumns(tableDef *conf.TableMapping, columns []*CatalogColumn) bool {
+	return slices.ContainsFunc(columns, func(c *CatalogColumn) bool {
+		return selectColumn(tableDef, columns, c.Name) != "t."+QuoteName(c.Name)
+	})
+}
+
+func columnType(columns []*CatalogColumn, column string) string {
+	for _, c := range columns {
+		if c.Name == column {
+			return strings.ToLower(c.Type)
+		}
+	}
+	return ""
+}
+
+// requiredColumns are the columns of a table that are read whatever fields are asked for.
+func requiredColumns(tableDef *conf.TableMapping) []string {
+	columns := slices.Clone(tableDef.IdColumns())
+	columns = append(columns, conf.KeyColumns(tableDef.EntityIdConstructor)...)
+	columns = append(columns, tableDef.SinceColumn, tableDef.RowVersionColumn, tableDef.SoftDeleteColumn)
+	for _, child := range tableDef.ChildReferences {
+		columns = append(columns, parentColumnOf(tableDef, child.ParentColumn))
+	}
+	for _, embedded := range tableDef.EmbeddedEntities {
+		columns = append(columns, parentColumnOf(tableDef, embedded.ParentColumn))
+	}
+	return columns
+}
+
+func parentColumnOf(tableDef *conf.TableMapping, parentColumn string) string {
+	if parentColumn != "" {
+		return parentColumn
+	}
+	return tableDef.IdColumn()
+}
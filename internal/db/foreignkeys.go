@@ -0,0 +1,61 @@
+package db
+
+import (
+	"database/sql"
+	"strings"
+)
+
+// ForeignKey is a foreign key of a table, as found in sys.foreign_keys. The columns are in the
+// order of the key, and each points at the referenced column at the same position.
+type ForeignKey struct {
+	Name              string
+	Columns           []string
+	ReferencedSchema  string
+	ReferencedTable   string
+	ReferencedColumns []string
+}
+
+// foreignKeysQuery lists the columns of the foreign keys of a table, one row per column.
+const foreignKeysQuery = `
+		SELECT fk.name, pc.name, rs.name, rt.name, rc.name
+		FROM sys.foreign_key_columns AS fkc
+		JOIN sys.foreign_keys AS fk ON fk.object_id = fkc.constraint_object_id
+		JOIN sys.columns AS pc ON pc.object_id = fkc.parent_object_id AND pc.column_id = fkc.parent_column_id
+		JOIN sys.columns AS rc ON rc.object_id = fkc.referenced_object_id AND rc.column_id = fkc.referenced_column_id
+		JOIN sys.tables AS rt ON rt.object_id = fkc.referenced_object_id
+		JOIN sys.schemas AS rs ON rs.schema_id = rt.schema_id
+		WHERE fkc.parent_object_id = OBJECT_ID(@p1)
+		ORDER BY fk.name, fkc.constraint_column_id`
+
+// ForeignKeys reads the foreign keys of a table from the catalog views.
+func ForeignKeys(sqlDB *sql.DB, schema string, table string) ([]*ForeignKey, error) {
+	rows, err := sqlDB.Query(foreignKeysQuery, TableName(schema, table))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	keys := make([]*ForeignKey, 0)
+	var fk *ForeignKey
+	for rows.Next() {
+		var name, column, refSchema, refTable, refColumn string
+		if err := rows.Scan(&name, &column, &refSchema, &refTable, &refColumn); err != nil {
+			return nil, err
+		}
+		if fk == nil || fk.Name != name {
+			fk = &ForeignKey{Name: name, ReferencedSchema: refSchema, ReferencedTable: refTable}
+			keys = append(keys, fk)
+		}
+		fk.Columns = append(fk.Columns, column)
+		fk.ReferencedColumns = append(fk.ReferencedColumns, refColumn)
+	}
+	return keys, rows.Err()
+}
+
+// References reports whether the foreign key points at a table, names compared the way the
+// default collation of SQL Server does, without case.
+func (fk *ForeignKey) References(schema string, table string) bool {
+	return strings.EqualFold(fk.ReferencedSchema, schema) && strings.EqualFold(fk.ReferencedTable, table)
+}
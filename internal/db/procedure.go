@@ -0,0 +1,170 @@
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-sql/civil"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+// ProcedureQuery calls the stored procedure, or selects from the table valued function, of a
+// dataset. A procedure is called by name, with its arguments bound as named parameters, and the
+// since parameter as an in/out parameter; see ProcedureSince. A function is read with a select,
+// with its arguments bound positionally.
+type ProcedureQuery struct {
+	Datalayer *conf.Datalayer
+	Request   DatasetRequest
+	TableDef  *conf.TableMapping
+}
+
+func (q ProcedureQuery) BuildQuery() (string, []any, error) {
+	if len(q.Request.Filters) > 0 || len(q.Request.Fields) > 0 {
+		return "", nil, fmt.Errorf("%w: a dataset read from a procedure can not be filtered", ErrInvalidRequest)
+	}
+	procedure := q.TableDef.Procedure
+	name := procedure.Name
+	if name == "" {
+		name = q.TableDef.TableName
+	}
+	name = TableName(q.Datalayer.GetSchema(q.TableDef), name)
+
+	values := make([]any, len(procedure.Arguments))
+	for i, arg := range procedure.Arguments {
+		value, err := ArgumentValue(arg, q.Request)
+		if err != nil {
+			return "", nil, err
+		}
+		values[i] = value
+	}
+
+	if procedure.Function {
+		args := params{}
+		limit := ""
+		if q.Request.Limit > 0 {
+			limit = fmt.Sprintf("TOP (%s) ", args.add(q.Request.Limit))
+		}
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			placeholders[i] = args.add(value)
+		}
+		return fmt.Sprintf("SELECT %s* FROM %s(%s)", limit, name, strings.Join(placeholders, ", ")), args, nil
+	}
+
+	args := make([]any, 0, len(values)+1)
+	for i, arg := range procedure.Arguments {
+		args = append(args, sql.Named(strings.TrimPrefix(arg.Name, "@"), values[i]))
+	}
+	if procedure.SinceParameter != "" {
+		token := q.Request.Since
+		args = append(args, sql.Named(strings.TrimPrefix(procedure.SinceParameter, "@"), sql.Out{Dest: &token, In: true}))
+	}
+	return name, args, nil
+}
+
+// DescribeStatement returns the call of the procedure, or the select from the function, of a
+// dataset with every argument null, for SQL Server to describe the result of; see
+// DescribeResultSet.
+func DescribeStatement(tableDef *conf.TableMapping, datalayer *conf.Datalayer) string {
+	procedure := tableDef.Procedure
+	name := procedure.Name
+	if name == "" {
+		name = tableDef.TableName
+	}
+	name = TableName(datalayer.GetSchema(tableDef), name)
+
+	if procedure.Function {
+		nulls := make([]string, len(procedure.Arguments))
+		for i := range nulls {
+			nulls[i] = "NULL"
+		}
+		return fmt.Sprintf("SELECT * FROM %s(%s)", name, strings.Join(nulls, ", "))
+	}
+	args := make([]string, 0, len(procedure.Arguments)+1)
+	for _, arg := range procedure.Arguments {
+		args = append(args, "@"+strings.TrimPrefix(arg.Name, "@")+" = NULL")
+	}
+	if procedure.SinceParameter != "" {
+		args = append(args, "@"+strings.TrimPrefix(procedure.SinceParameter, "@")+" = NULL")
+	}
+	return strings.TrimSpace("EXEC " + name + " " + strings.Join(args, ", "))
+}
+
+// ProcedureSince returns the since token a procedure called with the arguments of a
+// ProcedureQuery set in its since parameter. It is set once all the result sets are read.
+func ProcedureSince(args []any) (string, bool) {
+	for _, arg := range args {
+		if named, ok := arg.(sql.NamedArg); ok {
+			if out, ok := named.Value.(sql.Out); ok {
+				if token, ok := out.Dest.(*string); ok {
+					return *token, true
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// ArgumentValue returns the value of a procedure argument for a request, converted to the type
+// of the argument. An argument from a query parameter that is missing from the request takes
+// the value from config, and one that can not be converted makes the request invalid.
+func ArgumentValue(arg *conf.ProcedureArgument, request DatasetRequest) (any, error) {
+	value := arg.Value
+	switch arg.Source {
+	case "", "config":
+	case "since":
+		if request.Since != "" {
+			value = request.Since
+		}
+	case "limit":
+		if request.Limit > 0 {
+			value = strconv.FormatInt(request.Limit, 10)
+		}
+	case "query":
+		if v, ok := request.Params[arg.Param()]; ok {
+			value = v
+		}
+	default:
+		return nil, fmt.Errorf("unknown source %s of argument %s", arg.Source, arg.Name)
+	}
+
+	typed, err := convertArgument(arg.Type, value)
+	if err != nil {
+		if arg.Source == "query" {
+			return nil, fmt.Errorf("%w: %s is not a valid %s: %v", ErrInvalidRequest, arg.Param(), arg.Type, err)
+		}
+		return nil, fmt.Errorf("argument %s is not a valid %s: %w", arg.Name, arg.Type, err)
+	}
+	return typed, nil
+}
+
+// convertArgument converts the text of an argument to its type. An empty value is null.
+func convertArgument(argType string, value string) (any, error) {
+	if value == "" && argType != "" && argType != "string" {
+		return nil, nil
+	}
+	switch argType {
+	case "", "string":
+		return value, nil
+	case "int":
+		return strconv.ParseInt(value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(value, 64)
+	case "bool":
+		return strconv.ParseBool(value)
+	case "datetime":
+		t, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return nil, err
+		}
+		return civil.DateTimeOf(t.UTC()), nil
+	case "date":
+		return civil.ParseDate(value)
+	default:
+		return nil, fmt.Errorf("unknown type %s", argType)
+	}
+}
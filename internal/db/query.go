@@ -3,9 +3,13 @@ package db
 import (
 	"encoding/base64"
 	"fmt"
+	"math"
+	"os"
 	"strings"
 	"time"
 
+	"github.com/golang-sql/civil"
+
 	"github.com/mimiro-io/mssqldatalayer/internal/conf"
 )
 
@@ -13,10 +17,21 @@ type DatasetRequest struct {
 	DatasetName string
 	Since       string
 	Limit       int64
+	Entities    bool              // set when serving /entities, which pages by id instead of reading changes
+	From        string            // continuation token of the previous /entities page
+	Until       string            // token of the position a change read stops at, set by the layer
+	Capture     *CaptureInstance  // capture instance of a cdc read, set by the layer
+	Filters     []Filter          // predicates on mapped properties the rows read must match
+	Fields      []string          // mapped properties to read, all columns if empty
+	Params      map[string]string // query parameters the arguments of a procedure are bound from
+	SinceType   string            // data type of the since column, set by the layer
+	Columns     []*CatalogColumn  // columns of the table, set by the layer so the ones JSON can not hold are converted
 }
 
+// TableQuery builds the statement for a dataset request. The returned arguments are bound
+// positionally to the @p1, @p2, ... placeholders in the statement.
 type TableQuery interface {
-	BuildQuery() string
+	BuildQuery() (string, []any, error)
 }
 
 type FullQuery struct {
@@ -26,8 +41,38 @@ type FullQuery struct {
 }
 
 func NewQuery(request DatasetRequest, tableDef *conf.TableMapping, datalayer *conf.Datalayer) TableQuery {
-	if strings.Contains(tableDef.CustomQuery, "{{ since }}") {
-		return CustomSinceQuery{
+	if tableDef.Procedure != nil {
+		return ProcedureQuery{
+			Datalayer: datalayer,
+			Request:   request,
+			TableDef:  tableDef,
+		}
+	} else if request.Entities && tableDef.CustomQuery == "" && len(tableDef.IdColumns()) > 0 {
+		return EntitiesQuery{
+			Datalayer: datalayer,
+			Request:   request,
+			TableDef:  tableDef,
+		}
+	} else if conf.IsTemplate(tableDef.CustomQuery) {
+		return TemplateQuery{
+			Datalayer: datalayer,
+			Request:   request,
+			TableDef:  tableDef,
+		}
+	} else if tableDef.RowVersionColumn != "" && !request.Entities && (request.Since != "" || request.Limit > 0) {
+		return RowVersionQuery{
+			Datalayer: datalayer,
+			Request:   request,
+			TableDef:  tableDef,
+		}
+	} else if tableDef.SinceColumn != "" && tableDef.CustomQuery == "" {
+		return SinceColumnQuery{
+			Datalayer: datalayer,
+			Request:   request,
+			TableDef:  tableDef,
+		}
+	} else if tableDef.ChangeTracking && request.Since != "" {
+		return ChangeTrackingQuery{
 			Datalayer: datalayer,
 			Request:   request,
 			TableDef:  tableDef,
@@ -47,72 +92,303 @@ func NewQuery(request DatasetRequest, tableDef *conf.TableMapping, datalayer *co
 	}
 }
 
-func (q FullQuery) BuildQuery() string {
-	schema := q.Datalayer.GetSchema(q.TableDef)
-	//tableName := fmt.Sprintf("[%s].[%s]", schema, q.TableDef.TableName)
-	tableName := fmt.Sprintf("%s", q.TableDef.TableName)
-	if schema != "" {
-		tableName = fmt.Sprintf("[%s].[%s]", schema, q.TableDef.TableName)
-	}
+func (q FullQuery) BuildQuery() (string, []any, error) {
+	tableName := TableName(q.Datalayer.GetSchema(q.TableDef), q.TableDef.TableName)
 
+	args := params{}
 	limit := ""
 	if q.Request.Limit > 0 {
-		limit = fmt.Sprintf(" TOP %d ", q.Request.Limit)
+		limit = fmt.Sprintf("TOP (%s) ", args.add(q.Request.Limit))
+	}
+	columns, alias, err := RequestColumns(q.Request, q.TableDef, q.Datalayer)
+	if err != nil {
+		return "", nil, err
 	}
-	query := fmt.Sprintf("SELECT %s * FROM %s", limit, tableName)
+	where, err := filterPredicates(q.Request, q.TableDef, &args, columnPrefix(alias))
+	if err != nil {
+		return "", nil, err
+	}
+	if where != "" {
+		where = " WHERE " + where
+	}
+	query := fmt.Sprintf("SELECT %s%s FROM %s%s%s", limit, columns, tableName, alias, where)
 	if q.TableDef.CustomQuery != "" {
-		query = fmt.Sprintf(q.TableDef.CustomQuery, limit)
+		// a custom query without placeholders has the TOP clause put in its %s, if it has one
+		query = q.TableDef.CustomQuery
+		if strings.Contains(query, "%s") {
+			query = fmt.Sprintf(query, limit)
+		} else {
+			args = params{}
+		}
+	}
+
+	return query, args, nil
+}
+
+// EntitiesQuery reads a table in id column order. Each page starts right after the id
+// held by the From cursor, so a client can resume a full read at any page boundary. A table
+// with a composite key is read in the order of its key columns, and resumed after the key.
+type EntitiesQuery struct {
+	Datalayer *conf.Datalayer
+	Request   DatasetRequest
+	TableDef  *conf.TableMapping
+}
+
+func (q EntitiesQuery) BuildQuery() (string, []any, error) {
+	tableName := TableName(q.Datalayer.GetSchema(q.TableDef), q.TableDef.TableName)
+	keyColumns := make([]string, 0, 1)
+	for _, column := range q.TableDef.IdColumns() {
+		keyColumns = append(keyColumns, QuoteName(column))
+	}
+
+	args := params{}
+	limit := ""
+	if q.Request.Limit > 0 {
+		limit = fmt.Sprintf("TOP (%s) ", args.add(q.Request.Limit))
+	}
+	columns, alias, err := RequestColumns(q.Request, q.TableDef, q.Datalayer)
+	if err != nil {
+		return "", nil, err
+	}
+	predicates := make([]string, 0, 2)
+	if q.Request.From != "" {
+		cursor, err := DecodeCursor(q.Request.From)
+		if err != nil {
+			return "", nil, err
+		}
+		values, err := cursor.Args()
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid entities token %q: %w", q.Request.From, err)
+		}
+		if len(values) != len(keyColumns) {
+			return "", nil, fmt.Errorf("invalid entities token %q: %d key values for %d key columns", q.Request.From, len(values), len(keyColumns))
+		}
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			placeholders[i] = args.add(value)
+		}
+		predicates = append(predicates, keysetPredicate(keyColumns, placeholders))
 	}
+	filters, err := filterPredicates(q.Request, q.TableDef, &args, columnPrefix(alias))
+	if err != nil {
+		return "", nil, err
+	}
+	if filters != "" {
+		predicates = append(predicates, filters)
+	}
+
+	query := fmt.Sprintf("SELECT %s%s FROM %s%s%s ORDER BY %s", limit, columns, tableName, alias, whereClause(predicates), strings.Join(keyColumns, ", "))
+	return query, args, nil
+}
 
-	return query
+// keysetPredicate matches the rows after a key in key column order. SQL Server has no row
+// value comparison, so (a, b) > (@p1, @p2) is spelled out as a > @p1 OR (a = @p1 AND b > @p2).
+func keysetPredicate(columns []string, placeholders []string) string {
+	predicate := fmt.Sprintf("%s > %s", columns[len(columns)-1], placeholders[len(columns)-1])
+	for i := len(columns) - 2; i >= 0; i-- {
+		predicate = fmt.Sprintf("(%s > %s OR (%s = %s AND %s))", columns[i], placeholders[i], columns[i], placeholders[i], predicate)
+	}
+	return predicate
 }
 
-type CustomSinceQuery struct {
+// TemplateQuery runs a custom query with placeholders, each replaced with a bound parameter:
+//   - {{ limit }} is the limit of the request, or the largest bigint without one
+//   - {{ offset }} is the number of rows read by the earlier pages of an entities read
+//   - {{ since }} is the time of the since token, the start of time without one, compared as
+//     a datetime, or as the type given like {{ since:datetime2 }}; see sinceValue
+//   - {{ param.name }} is a query parameter of the request, and {{ env.NAME }} an environment
+//     variable, converted to their type like a procedure argument. When not set, they are an
+//     empty string, or null for other types.
+type TemplateQuery struct {
 	Datalayer *conf.Datalayer
 	Request   DatasetRequest
 	TableDef  *conf.TableMapping
 }
 
-func (q CustomSinceQuery) BuildQuery() string {
-	date := fmt.Sprintf("DATETIMEFROMPARTS( %d, %d, %d, %d, %d, %d, %d)",
-		1970, 01, 01, 00, 00, 00, 000)
-	data, err := base64.StdEncoding.DecodeString(q.Request.Since)
-	if err == nil && string(data) != "" {
-		dt, _ := time.Parse(time.RFC3339, string(data))
-		date = fmt.Sprintf("DATETIMEFROMPARTS( %d, %d, %d, %d, %d, %d, %d)",
-			dt.Year(), dt.Month(), dt.Day(), dt.Hour(), dt.Minute(), dt.Second(), dt.Nanosecond()/1000000)
+func (q TemplateQuery) BuildQuery() (string, []any, error) {
+	if len(q.Request.Filters) > 0 || len(q.Request.Fields) > 0 {
+		return "", nil, fmt.Errorf("%w: a dataset with a custom query can not be filtered", ErrInvalidRequest)
+	}
+	template, err := conf.ParseQueryTemplate(q.TableDef.CustomQuery)
+	if err != nil {
+		return "", nil, err
 	}
 
-	replaceQuery := strings.Replace(q.TableDef.CustomQuery, "{{ since }}", date, 1)
-	query := replaceQuery
+	args := params{}
+	query := template.Query
+	for _, p := range template.Placeholders {
+		var value any
+		expr := ""
+		switch p.Source {
+		case "limit":
+			value = int64(math.MaxInt64)
+			if q.Request.Limit > 0 {
+				value = q.Request.Limit
+			}
+		case "offset":
+			value, err = Offset(q.Request.From)
+		case "since":
+			since := time.Unix(0, 0).UTC()
+			if q.Request.Since != "" {
+				since, err = DecodeSince(q.Request.Since)
+			}
+			sinceType := p.Type
+			if sinceType == "" {
+				sinceType = "datetime"
+			}
+			if err == nil {
+				expr = sinceValue(&args, since, sinceType)
+			}
+		case "param":
+			value, err = convertArgument(p.Type, q.Request.Params[p.Name])
+			if err != nil {
+				err = fmt.Errorf("%w: %s is not a valid %s: %v", ErrInvalidRequest, p.Name, p.Type, err)
+			}
+		case "env":
+			value, err = convertArgument(p.Type, os.Getenv(p.Name))
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if expr == "" {
+			expr = args.add(value)
+		}
+		query = strings.Replace(query, p.Text, expr, 1)
+	}
+	return query, args, nil
+}
 
-	return query
+// Offset returns the number of rows an entities read of a query template has read before the
+// page of a From token, 0 for the first page.
+func Offset(from string) (int64, error) {
+	if from == "" {
+		return 0, nil
+	}
+	cursor, err := DecodeCursor(from)
+	if err != nil {
+		return 0, err
+	}
+	arg, err := cursor.Arg()
+	if err != nil {
+		return 0, err
+	}
+	offset, ok := arg.(int64)
+	if !ok {
+		return 0, fmt.Errorf("invalid entities token %q: not an offset", from)
+	}
+	return offset, nil
 }
 
-type CDCQuery struct {
+// SinceColumnQuery reads the rows of a table with a since column value after the since token,
+// in since column order. The token is taken from the rows read, so a page is read with ties to
+// never end inside the rows of one value.
+type SinceColumnQuery struct {
 	Datalayer *conf.Datalayer
 	Request   DatasetRequest
 	TableDef  *conf.TableMapping
 }
 
-func (q CDCQuery) BuildQuery() string {
-	schema := "dbo"
-	if q.TableDef.Config != nil && q.TableDef.Config.Schema != nil {
-		schema = *q.TableDef.Config.Schema
+func (q SinceColumnQuery) BuildQuery() (string, []any, error) {
+	tableName := TableName(q.Datalayer.GetSchema(q.TableDef), q.TableDef.TableName)
+	column := QuoteName(q.TableDef.SinceColumn)
+
+	args := params{}
+	limit := ""
+	if q.Request.Limit > 0 {
+		limit = fmt.Sprintf("TOP (%s) WITH TIES ", args.add(q.Request.Limit))
+	}
+	columns, alias, err := RequestColumns(q.Request, q.TableDef, q.Datalayer)
+	if err != nil {
+		return "", nil, err
+	}
+	predicates := make([]string, 0, 2)
+	if q.Request.Since != "" {
+		since, err := DecodeSince(q.Request.Since)
+		if err != nil {
+			return "", nil, err
+		}
+		predicates = append(predicates, fmt.Sprintf("%s > %s", column, sinceValue(&args, since, q.Request.SinceType)))
+	}
+	filters, err := filterPredicates(q.Request, q.TableDef, &args, columnPrefix(alias))
+	if err != nil {
+		return "", nil, err
+	}
+	if filters != "" {
+		predicates = append(predicates, filters)
 	}
 
-	lastLsn := fmt.Sprintf("sys.fn_cdc_get_min_lsn('%s_%s')", schema, q.TableDef.TableName)
-	data, err := base64.RawURLEncoding.DecodeString(q.Request.Since)
-	if err == nil && strings.HasPrefix(string(data), "0x") && len(data) == 22 {
-		lastLsn = fmt.Sprintf("CONVERT(binary(10), %s)", string(data))
+	query := fmt.Sprintf("SELECT %s%s FROM %s%s%s ORDER BY %s", limit, columns, tableName, alias, whereClause(predicates), column)
+	return query, args, nil
+}
+
+// sinceValue binds the time of a since token for a comparison with a column of a data type, and
+// returns the expression to compare the column with. The time is bound as a datetime2, which
+// holds it in full. A datetime column holds 1/300 seconds, which the driver reads rounded to the
+// millisecond, so a token of .003 is taken from a row at .00333. The time is cast to datetime on
+// the server, which rounds it back to the tick of the row, or that row would be read again after
+// the token. A smalldatetime is cast the same way.
+func sinceValue(args *params, since time.Time, columnType string) string {
+	arg := args.add(civil.DateTimeOf(since))
+	switch strings.ToLower(columnType) {
+	case "datetime", "smalldatetime":
+		return fmt.Sprintf("CAST(%s AS %s)", arg, strings.ToLower(columnType))
+	}
+	return arg
+}
+
+// EncodeSince returns a since column value as a continuation token.
+func EncodeSince(since time.Time) string {
+	return base64.StdEncoding.EncodeToString([]byte(since.Format(time.RFC3339Nano)))
+}
+
+// DecodeSince reads a token created by EncodeSince. Tokens without fractional seconds, as
+// handed out by earlier versions of the layer, are read as well.
+func DecodeSince(token string) (time.Time, error) {
+	data, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since token %q: %w", token, err)
+	}
+	since, err := time.Parse(time.RFC3339Nano, string(data))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid since token %q: %w", token, err)
+	}
+	return since, nil
+}
+
+// params collects the arguments of a statement and hands out their placeholders.
+type params []any
+
+func (p *params) add(value any) string {
+	*p = append(*p, value)
+	return fmt.Sprintf("@p%d", len(*p))
+}
+
+// whereClause joins the predicates of a query into its WHERE clause, or "" if there are none.
+func whereClause(predicates []string) string {
+	if len(predicates) == 0 {
+		return ""
 	}
+	return " WHERE " + strings.Join(predicates, " AND ")
+}
 
-	query := fmt.Sprintf(`
-		DECLARE @from_lsn binary(10), @to_lsn binary(10), @last_lsn binary(10);
-		SET @last_lsn = %s;
-		SET @from_lsn = sys.fn_cdc_increment_lsn(@last_lsn);
-		SET @to_lsn = sys.fn_cdc_get_max_lsn();
-		SELECT * from cdc.fn_cdc_get_all_changes_%s_%s ( @from_lsn, @to_lsn, 'all' );
-`, lastLsn, schema, q.TableDef.TableName)
-	return query
-}
\ No newline at end of file
+// columnPrefix returns the prefix of the columns of a table read with an alias.
+func columnPrefix(alias string) string {
+	if alias == "" {
+		return ""
+	}
+	return "t."
+}
+
+// QuoteName delimits an identifier the way T-SQL QUOTENAME does, so it can be safely
+// spliced into a statement where a parameter is not allowed.
+func QuoteName(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+// TableName returns the delimited, optionally schema qualified, name of a table.
+func TableName(schema string, table string) string {
+	if schema == "" {
+		return QuoteName(table)
+	}
+	return QuoteName(schema) + "." + QuoteName(table)
+}
@@ -1,13 +1,18 @@
 package db
 
 import (
+	"database/sql"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"testing"
 	"time"
 
 	goblin "github.com/franela/goblin"
+	"github.com/golang-sql/civil"
+	mssql "github.com/microsoft/go-mssqldb"
 	. "github.com/onsi/gomega"
 
 	"github.com/mimiro-io/mssqldatalayer/internal/conf"
@@ -32,8 +37,65 @@ func TestNewQueryWithFullQuery(t *testing.T) {
 			query := NewQuery(DatasetRequest{}, layer.TableMappings[0], layer)
 			Expect(query).Should(BeAssignableToTypeOf(FullQuery{}))
 
-			q := query.BuildQuery()
-			g.Assert(q).Equal("SELECT  * FROM [dbo].[Table1]")
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM [dbo].[Table1]")
+			g.Assert(len(args)).Equal(0)
+		})
+
+		g.It("should bind the limit as a parameter", func() {
+			tm := []*conf.TableMapping{
+				{
+					TableName: "Table1",
+				},
+			}
+
+			layer := &conf.Datalayer{
+				Schema:        "dbo",
+				TableMappings: tm,
+			}
+			query := NewQuery(DatasetRequest{Limit: 10}, layer.TableMappings[0], layer)
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[Table1]")
+			g.Assert(args).Equal([]any{int64(10)})
+		})
+
+		g.It("should quote odd table names", func() {
+			tm := []*conf.TableMapping{
+				{
+					TableName: "Table]; DROP TABLE x; --",
+				},
+			}
+
+			layer := &conf.Datalayer{
+				TableMappings: tm,
+			}
+			query := NewQuery(DatasetRequest{}, layer.TableMappings[0], layer)
+
+			q, _, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM [Table]]; DROP TABLE x; --]")
+		})
+
+		g.It("should aggregate child references in the same query", func() {
+			table := &conf.TableMapping{
+				TableName: "Orders",
+				ColumnMappings: []*conf.ColumnMapping{
+					{FieldName: "Id", IsIdColumn: true},
+				},
+				ChildReferences: []*conf.ChildReference{
+					{TableName: "OrderLines", ForeignKey: "OrderId", KeyColumn: "LineId", ReferenceTemplate: "http://data.test.io/orderlines/%v"},
+				},
+			}
+			layer := &conf.Datalayer{Schema: "dbo"}
+			query := NewQuery(DatasetRequest{Limit: 10}, table, layer)
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) t.*, (SELECT c.[LineId] AS [v] FROM [dbo].[OrderLines] AS c WHERE c.[OrderId] = t.[Id] ORDER BY c.[LineId] FOR JSON PATH) AS [__$children_0] FROM [dbo].[Orders] AS t")
+			g.Assert(args).Equal([]any{int64(10)})
 		})
 
 		g.It("should be full query if not since is provided", func() {
@@ -52,8 +114,9 @@ func TestNewQueryWithFullQuery(t *testing.T) {
 			query := NewQuery(DatasetRequest{}, layer.TableMappings[0], layer)
 			Expect(query).Should(BeAssignableToTypeOf(FullQuery{}))
 
-			q := query.BuildQuery()
-			g.Assert(q).Equal("SELECT  * FROM [dbo].[Table1]")
+			q, _, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM [dbo].[Table1]")
 		})
 	})
 
@@ -84,8 +147,921 @@ func TestNewQuery_WithCDC(t *testing.T) {
 			query := NewQuery(DatasetRequest{Since: token}, layer.TableMappings[0], layer)
 			Expect(query).Should(BeAssignableToTypeOf(CDCQuery{}))
 
-			g.Assert(strings.Contains(query.BuildQuery(), "SELECT * from cdc.fn_cdc_get_all_changes_dbo_Table1")).IsTrue()
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(strings.Contains(q, "SELECT * from cdc.[fn_cdc_get_all_changes_dbo_Table1]")).IsTrue()
+			g.Assert(strings.Contains(q, "sys.fn_cdc_get_min_lsn(@p1)")).IsTrue()
+			g.Assert(args).Equal([]any{"dbo_Table1", "all"})
+		})
+
+		g.It("should bind a valid lsn token as binary", func() {
+			tm := []*conf.TableMapping{
+				{
+					TableName:  "Table1",
+					CDCEnabled: true,
+				},
+			}
+
+			layer := &conf.Datalayer{
+				TableMappings: tm,
+			}
+
+			token := base64.RawURLEncoding.EncodeToString([]byte("0x0000002a000001f00003"))
+
+			query := NewQuery(DatasetRequest{Since: token}, layer.TableMappings[0], layer)
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(strings.Contains(q, "SET @last_lsn = @p2;")).IsTrue()
+			g.Assert(args[1]).Equal([]byte{0x00, 0x00, 0x00, 0x2a, 0x00, 0x00, 0x01, 0xf0, 0x00, 0x03})
+		})
+
+		g.It("should cap the read at the limit and bound it by the until token", func() {
+			tm := []*conf.TableMapping{
+				{
+					TableName:  "Table1",
+					CDCEnabled: true,
+				},
+			}
+
+			layer := &conf.Datalayer{
+				TableMappings: tm,
+			}
+
+			since := CDCToken{Lsn: []byte{0, 0, 0, 0x2a, 0, 0, 0x01, 0xf0, 0, 0x03}}.Encode()
+			until := CDCToken{Lsn: []byte{0, 0, 0, 0x2b, 0, 0, 0, 0x10, 0, 0x01}}.Encode()
+
+			query := NewQuery(DatasetRequest{Since: since, Until: until, Limit: 500}, layer.TableMappings[0], layer)
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(strings.Contains(q, "SET @from_lsn = sys.fn_cdc_increment_lsn(@last_lsn);")).IsTrue()
+			g.Assert(strings.Contains(q, "SET @to_lsn = @p3;")).IsTrue()
+			g.Assert(strings.Contains(q, "SELECT TOP (@p4) WITH TIES * from cdc.[fn_cdc_get_all_changes_dbo_Table1] ( @from_lsn, @to_lsn, @p5 ) ORDER BY [__$start_lsn], [__$seqval];")).IsTrue()
+			g.Assert(args[2]).Equal([]byte{0, 0, 0, 0x2b, 0, 0, 0, 0x10, 0, 0x01})
+			g.Assert(args[3]).Equal(int64(500))
+		})
+
+		g.It("should continue inside an lsn after the last seqval read", func() {
+			tm := []*conf.TableMapping{
+				{
+					TableName:  "Table1",
+					CDCEnabled: true,
+				},
+			}
+
+			layer := &conf.Datalayer{
+				TableMappings: tm,
+			}
+
+			token := CDCToken{
+				Lsn:    []byte{0, 0, 0, 0x2a, 0, 0, 0x01, 0xf0, 0, 0x03},
+				Seqval: []byte{0, 0, 0, 0x2a, 0, 0, 0x01, 0xf0, 0, 0x07},
+			}
+			decoded, ok := DecodeCDCToken(token.Encode())
+			g.Assert(ok).IsTrue()
+			g.Assert(decoded).Equal(token)
+
+			query := NewQuery(DatasetRequest{Since: token.Encode(), Limit: 500}, layer.TableMappings[0], layer)
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(strings.Contains(q, "SET @from_lsn = @last_lsn;")).IsTrue()
+			g.Assert(strings.Contains(q, "WHERE ([__$start_lsn] > @last_lsn OR ([__$start_lsn] = @last_lsn AND [__$seqval] > @p3))")).IsTrue()
+			g.Assert(args[2]).Equal(token.Seqval)
+		})
+
+		g.It("should read net changes when the capture instance supports them", func() {
+			table := &conf.TableMapping{
+				TableName:     "Table1",
+				CDCEnabled:    true,
+				CDCNetChanges: true,
+				CDCRowFilter:  "all with mask",
+			}
+			since := CDCToken{Lsn: []byte{0, 0, 0, 0x2a, 0, 0, 0x01, 0xf0, 0, 0x03}}.Encode()
+			capture := &CaptureInstance{Name: "dbo_Table1", SupportsNetChanges: true}
+
+			query := NewQuery(DatasetRequest{Since: since, Limit: 10, Capture: capture}, table, &conf.Datalayer{})
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(strings.Contains(q, "SELECT TOP (@p3) WITH TIES * from cdc.[fn_cdc_get_net_changes_dbo_Table1] ( @from_lsn, @to_lsn, @p4 ) ORDER BY [__$start_lsn];")).IsTrue()
+			g.Assert(args[3]).Equal("all with mask")
+		})
+
+		g.It("should fall back to all changes when net changes are not supported", func() {
+			table := &conf.TableMapping{
+				TableName:     "Table1",
+				CDCEnabled:    true,
+				CDCNetChanges: true,
+				CDCRowFilter:  "all with mask",
+			}
+			since := CDCToken{Lsn: []byte{0, 0, 0, 0x2a, 0, 0, 0x01, 0xf0, 0, 0x03}}.Encode()
+			capture := &CaptureInstance{Name: "dbo_Table1"}
+
+			query := NewQuery(DatasetRequest{Since: since, Capture: capture}, table, &conf.Datalayer{})
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(strings.Contains(q, "cdc.[fn_cdc_get_all_changes_dbo_Table1]")).IsTrue()
+			g.Assert(args[2]).Equal("all")
+		})
+
+		g.It("should reject an unknown row filter", func() {
+			table := &conf.TableMapping{
+				TableName:    "Table1",
+				CDCEnabled:   true,
+				CDCRowFilter: "all with mask",
+			}
+			since := CDCToken{Lsn: []byte{0, 0, 0, 0x2a, 0, 0, 0x01, 0xf0, 0, 0x03}}.Encode()
+
+			query := NewQuery(DatasetRequest{Since: since}, table, &conf.Datalayer{})
+			_, _, err := query.BuildQuery()
+			g.Assert(err == nil).IsFalse()
+		})
+
+		g.It("should not let a forged token reach the statement", func() {
+			tm := []*conf.TableMapping{
+				{
+					TableName:  "Table1",
+					CDCEnabled: true,
+				},
+			}
+
+			layer := &conf.Datalayer{
+				TableMappings: tm,
+			}
+
+			token := base64.RawURLEncoding.EncodeToString([]byte("0x00; DROP TABLE x;--"))
+
+			query := NewQuery(DatasetRequest{Since: token}, layer.TableMappings[0], layer)
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(strings.Contains(q, "DROP")).IsFalse()
+			g.Assert(args).Equal([]any{"dbo_Table1", "all"})
 		})
 	})
 
-}
\ No newline at end of file
+}
+func TestNewQuery_WithCustomSince(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when the custom query has a since placeholder", func() {
+		tm := []*conf.TableMapping{
+			{
+				TableName:   "Table1",
+				CustomQuery: "SELECT * FROM Table1 WHERE Changed > {{ since }}",
+				SinceColumn: "Changed",
+			},
+		}
+		layer := &conf.Datalayer{
+			TableMappings: tm,
+		}
+
+		g.It("should bind the since value as a parameter", func() {
+			token := base64.StdEncoding.EncodeToString([]byte("2023-01-02T03:04:05Z"))
+
+			query := NewQuery(DatasetRequest{Since: token}, layer.TableMappings[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(TemplateQuery{}))
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM Table1 WHERE Changed > CAST(@p1 AS datetime)")
+			g.Assert(args).Equal([]any{civil.DateTimeOf(time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC))})
+		})
+
+		g.It("should round a token read from a datetime to the tick of its row", func() {
+			// a row at .00333 is read as .003, which is below the row until it is cast back
+			token := EncodeSince(time.Date(2023, 1, 2, 3, 4, 5, 3000000, time.UTC))
+			q, args, err := NewQuery(DatasetRequest{Since: token, Limit: 1}, layer.TableMappings[0], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM Table1 WHERE Changed > CAST(@p1 AS datetime)")
+			g.Assert(args).Equal([]any{civil.DateTimeOf(time.Date(2023, 1, 2, 3, 4, 5, 3000000, time.UTC))})
+		})
+
+		g.It("should compare in the type given in the placeholder", func() {
+			table := &conf.TableMapping{TableName: "Table1", CustomQuery: "SELECT * FROM Table1 WHERE Changed > {{ since:datetime2 }}", SinceColumn: "Changed"}
+			token := EncodeSince(time.Date(2023, 1, 2, 3, 4, 5, 1234567, time.UTC))
+			q, args, err := NewQuery(DatasetRequest{Since: token}, table, layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM Table1 WHERE Changed > @p1")
+			g.Assert(args).Equal([]any{civil.DateTimeOf(time.Date(2023, 1, 2, 3, 4, 5, 1234567, time.UTC))})
+		})
+
+		g.It("should reject a malformed since value", func() {
+			token := base64.StdEncoding.EncodeToString([]byte("2023-01-02'); DROP TABLE x;--"))
+
+			query := NewQuery(DatasetRequest{Since: token}, layer.TableMappings[0], layer)
+			_, _, err := query.BuildQuery()
+			g.Assert(err == nil).IsFalse()
+		})
+	})
+}
+
+func TestNewQuery_WithTemplate(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when the custom query is a template", func() {
+		tm := []*conf.TableMapping{
+			{
+				TableName:   "Orders",
+				CustomQuery: "SELECT * FROM Orders WHERE Region = {{ param.region }} AND Amount >= {{ param.min:float }} AND Tenant = {{ env.TEMPLATE_TENANT:int }} ORDER BY Id OFFSET {{ offset }} ROWS FETCH NEXT {{ limit }} ROWS ONLY",
+			},
+			{
+				TableName:   "Customers",
+				CustomQuery: "SELECT %s * FROM Customers",
+			},
+			{
+				TableName:   "Products",
+				CustomQuery: "SELECT * FROM Products WHERE Name LIKE 'A%'",
+			},
+		}
+		layer := &conf.Datalayer{
+			TableMappings: tm,
+		}
+
+		g.It("should bind the placeholders as typed parameters", func() {
+			t.Setenv("TEMPLATE_TENANT", "42")
+			request := DatasetRequest{
+				Entities: true,
+				Limit:    100,
+				From:     NewCursor("BIGINT", int64(200)).Encode(),
+				Params:   map[string]string{"region": "north", "min": "9.5"},
+			}
+			query := NewQuery(request, tm[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(TemplateQuery{}))
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM Orders WHERE Region = @p1 AND Amount >= @p2 AND Tenant = @p3 ORDER BY Id OFFSET @p4 ROWS FETCH NEXT @p5 ROWS ONLY")
+			g.Assert(args).Equal([]any{"north", 9.5, int64(42), int64(200), int64(100)})
+		})
+
+		g.It("should read everything without a limit or parameters", func() {
+			t.Setenv("TEMPLATE_TENANT", "")
+			_, args, err := NewQuery(DatasetRequest{}, tm[0], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(args).Equal([]any{"", nil, nil, int64(0), int64(math.MaxInt64)})
+		})
+
+		g.It("should reject a parameter that is not of its type", func() {
+			_, _, err := NewQuery(DatasetRequest{Params: map[string]string{"min": "lots"}}, tm[0], layer).BuildQuery()
+			g.Assert(errors.Is(err, ErrInvalidRequest)).IsTrue()
+		})
+
+		g.It("should still put the limit in the %s of a query without placeholders", func() {
+			q, args, err := NewQuery(DatasetRequest{Limit: 10}, tm[1], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1)  * FROM Customers")
+			g.Assert(args).Equal([]any{int64(10)})
+
+			q, args, err = NewQuery(DatasetRequest{Limit: 10}, tm[2], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM Products WHERE Name LIKE 'A%'")
+			g.Assert(len(args)).Equal(0)
+		})
+	})
+}
+
+func TestNewQuery_WithSinceColumn(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when set up with a since column", func() {
+		tm := []*conf.TableMapping{
+			{
+				TableName:   "Table1",
+				SinceColumn: "Changed",
+			},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: tm,
+		}
+
+		g.It("should read the full table in since column order without a token", func() {
+			query := NewQuery(DatasetRequest{}, layer.TableMappings[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(SinceColumnQuery{}))
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM [dbo].[Table1] ORDER BY [Changed]")
+			g.Assert(len(args)).Equal(0)
+		})
+
+		g.It("should read the rows after the token with full precision", func() {
+			since := time.Date(2023, 1, 2, 3, 4, 5, 123456700, time.UTC)
+			query := NewQuery(DatasetRequest{Since: EncodeSince(since), Limit: 10}, layer.TableMappings[0], layer)
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) WITH TIES * FROM [dbo].[Table1] WHERE [Changed] > @p2 ORDER BY [Changed]")
+			g.Assert(args).Equal([]any{int64(10), civil.DateTimeOf(since)})
+		})
+
+		g.It("should compare a datetime column in its own type", func() {
+			// the driver reads the datetime ticks at .00333 and .00667 as .003 and .007
+			for _, ms := range []int{3, 7} {
+				since := time.Date(2023, 1, 2, 3, 4, 5, ms*int(time.Millisecond), time.UTC)
+				request := DatasetRequest{Since: EncodeSince(since), Limit: 1, SinceType: "datetime"}
+
+				q, args, err := NewQuery(request, layer.TableMappings[0], layer).BuildQuery()
+				g.Assert(err).IsNil()
+				g.Assert(q).Equal("SELECT TOP (@p1) WITH TIES * FROM [dbo].[Table1] WHERE [Changed] > CAST(@p2 AS datetime) ORDER BY [Changed]")
+				g.Assert(args).Equal([]any{int64(1), civil.DateTimeOf(since)})
+			}
+
+			request := DatasetRequest{Since: EncodeSince(time.Date(2023, 1, 2, 3, 4, 0, 0, time.UTC)), SinceType: "datetime2"}
+			q, _, err := NewQuery(request, layer.TableMappings[0], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM [dbo].[Table1] WHERE [Changed] > @p1 ORDER BY [Changed]")
+		})
+
+		g.It("should read tokens without fractional seconds", func() {
+			token := base64.StdEncoding.EncodeToString([]byte("2023-01-02T03:04:05.000Z"))
+			since, err := DecodeSince(token)
+			g.Assert(err).IsNil()
+			g.Assert(since.Equal(time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC))).IsTrue()
+		})
+
+		g.It("should reject a token that is not a time", func() {
+			query := NewQuery(DatasetRequest{Since: EncodeVersion(41)}, layer.TableMappings[0], layer)
+			_, _, err := query.BuildQuery()
+			g.Assert(err == nil).IsFalse()
+		})
+	})
+}
+
+func TestNewQuery_WithEntities(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when paging through entities", func() {
+		tm := []*conf.TableMapping{
+			{
+				TableName: "Table1",
+				ColumnMappings: []*conf.ColumnMapping{
+					{FieldName: "Id", IsIdColumn: true},
+				},
+			},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: tm,
+		}
+
+		g.It("should order the first page by the id column", func() {
+			query := NewQuery(DatasetRequest{Entities: true, Limit: 100}, layer.TableMappings[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(EntitiesQuery{}))
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[Table1] ORDER BY [Id]")
+			g.Assert(args).Equal([]any{int64(100)})
+		})
+
+		g.It("should resume after the id in the token", func() {
+			token := NewCursor("VARCHAR", "a:42").Encode()
+
+			query := NewQuery(DatasetRequest{Entities: true, Limit: 100, From: token}, layer.TableMappings[0], layer)
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[Table1] WHERE [Id] > @p2 ORDER BY [Id]")
+			g.Assert(args[1]).Equal(mssql.VarChar("a:42"))
+		})
+
+		g.It("should keep integer ids as integers", func() {
+			token := NewCursor("BIGINT", int64(9007199254740993)).Encode()
+
+			query := NewQuery(DatasetRequest{Entities: true, From: token}, layer.TableMappings[0], layer)
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM [dbo].[Table1] WHERE [Id] > @p1 ORDER BY [Id]")
+			g.Assert(args[0]).Equal(int64(9007199254740993))
+		})
+
+		g.It("should carry the change token from page to page", func() {
+			cursor := NewCursor("INT", int64(7))
+			cursor.Since = EncodeVersion(42)
+
+			from, err := DecodeCursor(cursor.Encode())
+			g.Assert(err).IsNil()
+			g.Assert(from.Since).Equal(EncodeVersion(42))
+			arg, err := from.Arg()
+			g.Assert(err).IsNil()
+			g.Assert(arg).Equal(int64(7))
+		})
+
+		g.It("should reject a token that is not a cursor", func() {
+			query := NewQuery(DatasetRequest{Entities: true, From: "not a token"}, layer.TableMappings[0], layer)
+			_, _, err := query.BuildQuery()
+			g.Assert(err == nil).IsFalse()
+		})
+
+		g.It("should page a composite key by all its columns", func() {
+			table := &conf.TableMapping{
+				TableName: "OrderLines",
+				ColumnMappings: []*conf.ColumnMapping{
+					{FieldName: "OrderId", IsIdColumn: true},
+					{FieldName: "LineNo", IsIdColumn: true},
+				},
+			}
+			query := NewQuery(DatasetRequest{Entities: true, Limit: 100}, table, layer)
+			Expect(query).Should(BeAssignableToTypeOf(EntitiesQuery{}))
+			q, _, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[OrderLines] ORDER BY [OrderId], [LineNo]")
+
+			token := NewKeyCursor([]string{"INT", "SMALLINT"}, []any{int64(7), int64(3)}).Encode()
+			q, args, err := NewQuery(DatasetRequest{Entities: true, Limit: 100, From: token}, table, layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[OrderLines] WHERE ([OrderId] > @p2 OR ([OrderId] = @p2 AND [LineNo] > @p3)) ORDER BY [OrderId], [LineNo]")
+			g.Assert(args).Equal([]any{int64(100), int64(7), int64(3)})
+		})
+
+		g.It("should reject a token for another key", func() {
+			table := &conf.TableMapping{
+				TableName: "OrderLines",
+				ColumnMappings: []*conf.ColumnMapping{
+					{FieldName: "OrderId", IsIdColumn: true},
+					{FieldName: "LineNo", IsIdColumn: true},
+				},
+			}
+			token := NewCursor("INT", int64(7)).Encode()
+			_, _, err := NewQuery(DatasetRequest{Entities: true, Limit: 100, From: token}, table, layer).BuildQuery()
+			g.Assert(err == nil).IsFalse()
+		})
+
+		g.It("should fall back to a full query without an id column", func() {
+			table := &conf.TableMapping{TableName: "Table2"}
+			query := NewQuery(DatasetRequest{Entities: true, Limit: 100}, table, layer)
+			Expect(query).Should(BeAssignableToTypeOf(FullQuery{}))
+		})
+	})
+}
+
+func TestNewQuery_WithChangeTracking(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when set up for change tracking", func() {
+		tm := []*conf.TableMapping{
+			{
+				TableName:      "Table1",
+				ChangeTracking: true,
+				ColumnMappings: []*conf.ColumnMapping{
+					{FieldName: "Id", IsIdColumn: true},
+				},
+			},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: tm,
+		}
+
+		g.It("should read the full table without a token", func() {
+			query := NewQuery(DatasetRequest{}, layer.TableMappings[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(FullQuery{}))
+		})
+
+		g.It("should join the change table back to the table", func() {
+			query := NewQuery(DatasetRequest{Since: EncodeVersion(41), Until: EncodeVersion(57), Limit: 100}, layer.TableMappings[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(ChangeTrackingQuery{}))
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) WITH TIES t.*, ct.[Id], ct.SYS_CHANGE_VERSION AS [__$sys_change_version], CAST(ct.SYS_CHANGE_OPERATION AS varchar(1)) AS [__$sys_change_operation] " +
+				"FROM CHANGETABLE(CHANGES [dbo].[Table1], @p2) AS ct LEFT OUTER JOIN [dbo].[Table1] AS t ON t.[Id] = ct.[Id] WHERE ct.SYS_CHANGE_VERSION <= @p3 ORDER BY ct.SYS_CHANGE_VERSION")
+			g.Assert(args).Equal([]any{int64(100), int64(41), int64(57)})
+		})
+
+		g.It("should join on every column of a composite key", func() {
+			table := &conf.TableMapping{
+				TableName:      "OrderLines",
+				ChangeTracking: true,
+				ColumnMappings: []*conf.ColumnMapping{
+					{FieldName: "OrderId", IsIdColumn: true},
+					{FieldName: "LineNo", IsIdColumn: true},
+				},
+			}
+			query := NewQuery(DatasetRequest{Since: EncodeVersion(41)}, table, layer)
+
+			q, _, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT t.*, ct.[OrderId], ct.[LineNo], ct.SYS_CHANGE_VERSION AS [__$sys_change_version], CAST(ct.SYS_CHANGE_OPERATION AS varchar(1)) AS [__$sys_change_operation] " +
+				"FROM CHANGETABLE(CHANGES [dbo].[OrderLines], @p1) AS ct LEFT OUTER JOIN [dbo].[OrderLines] AS t ON t.[OrderId] = ct.[OrderId] AND t.[LineNo] = ct.[LineNo] ORDER BY ct.SYS_CHANGE_VERSION")
+		})
+
+		g.It("should reject a token that is not a version", func() {
+			query := NewQuery(DatasetRequest{Since: "bm90IGEgdmVyc2lvbg"}, layer.TableMappings[0], layer)
+			_, _, err := query.BuildQuery()
+			g.Assert(err == nil).IsFalse()
+		})
+	})
+}
+
+func TestNewQuery_WithRowVersion(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when set up with a rowversion column", func() {
+		tm := []*conf.TableMapping{
+			{
+				TableName:        "Table1",
+				RowVersionColumn: "Version",
+			},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: tm,
+		}
+
+		g.It("should read the full table without a token", func() {
+			query := NewQuery(DatasetRequest{}, layer.TableMappings[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(FullQuery{}))
+		})
+
+		g.It("should page a limited first read in rowversion order", func() {
+			until := RowVersionOf(0x7f0)
+			query := NewQuery(DatasetRequest{Until: EncodeRowVersion(until), Limit: 10}, layer.TableMappings[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(RowVersionQuery{}))
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[Table1] WHERE [Version] <= @p2 ORDER BY [Version]")
+			g.Assert(args).Equal([]any{int64(10), until})
+		})
+
+		g.It("should read the rows after the token in rowversion order", func() {
+			since := RowVersionOf(0x7d1)
+			until := RowVersionOf(0x7f0)
+			query := NewQuery(DatasetRequest{Since: EncodeRowVersion(since), Until: EncodeRowVersion(until), Limit: 10}, layer.TableMappings[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(RowVersionQuery{}))
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[Table1] WHERE [Version] > @p2 AND [Version] <= @p3 ORDER BY [Version]")
+			g.Assert(args).Equal([]any{int64(10), since, until})
+		})
+
+		g.It("should round trip the token", func() {
+			version, ok := DecodeRowVersion(EncodeRowVersion(RowVersionOf(0x7d1)))
+			g.Assert(ok).IsTrue()
+			g.Assert(version).Equal([]byte{0, 0, 0, 0, 0, 0, 0x07, 0xd1})
+		})
+
+		g.It("should reject a token that is not a rowversion", func() {
+			query := NewQuery(DatasetRequest{Since: EncodeVersion(41)}, layer.TableMappings[0], layer)
+			_, _, err := query.BuildQuery()
+			g.Assert(err == nil).IsFalse()
+		})
+	})
+}
+
+func TestEmbeddedQueries(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when set up with embedded entities", func() {
+		lines := &conf.EmbeddedEntity{
+			TableName:   "OrderLines",
+			ForeignKey:  "OrderId",
+			SinceColumn: "Modified",
+		}
+		addresses := &conf.EmbeddedEntity{
+			TableName:  "Addresses",
+			ForeignKey: "CustomerId",
+			CDCEnabled: true,
+		}
+		tm := []*conf.TableMapping{
+			{
+				TableName:        "Orders",
+				EmbeddedEntities: []*conf.EmbeddedEntity{lines, addresses},
+			},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: tm,
+		}
+
+		g.It("should read the rows of a batch of keys", func() {
+			query := KeyedQuery{Datalayer: layer, TableDef: lines.TableMapping(tm[0]), Column: "OrderId", Keys: []any{int64(1), int64(2)}}
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM [dbo].[OrderLines] WHERE [OrderId] IN (@p1, @p2)")
+			g.Assert(args).Equal([]any{int64(1), int64(2)})
+		})
+
+		g.It("should refuse to read without keys", func() {
+			_, _, err := KeyedQuery{Datalayer: layer, TableDef: tm[0], Column: "Id"}.BuildQuery()
+			g.Assert(err == nil).IsFalse()
+		})
+
+		g.It("should find the parents of rows changed after the since token", func() {
+			since := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+			until := time.Date(2024, 3, 2, 10, 0, 0, 0, time.UTC)
+			query := EmbeddedChangesQuery{Datalayer: layer, Request: DatasetRequest{Since: EncodeSince(since), Until: EncodeSince(until)}, TableDef: tm[0], Embedded: lines}
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT [OrderId], MAX([Modified]) FROM [dbo].[OrderLines] WHERE [Modified] > @p1 AND [Modified] <= @p2 GROUP BY [OrderId]")
+			g.Assert(args).Equal([]any{civil.DateTimeOf(since), civil.DateTimeOf(until)})
+		})
+
+		g.It("should compare a datetime since column in its own type", func() {
+			since := time.Date(2024, 3, 1, 10, 0, 0, 7*int(time.Millisecond), time.UTC)
+			query := EmbeddedChangesQuery{Datalayer: layer, Request: DatasetRequest{Since: EncodeSince(since)}, TableDef: tm[0], Embedded: lines, SinceType: "datetime"}
+			q, _, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT [OrderId], MAX([Modified]) FROM [dbo].[OrderLines] WHERE [Modified] > CAST(@p1 AS datetime) GROUP BY [OrderId]")
+		})
+
+		g.It("should find the parents of rows changed in the lsn range", func() {
+			since := CDCToken{Lsn: []byte{0, 0, 0, 0x2a, 0, 0, 0, 0x10, 0, 0x01}}
+			until := CDCToken{Lsn: []byte{0, 0, 0, 0x2b, 0, 0, 0, 0x20, 0, 0x01}}
+			query := EmbeddedChangesQuery{Datalayer: layer, Request: DatasetRequest{Since: since.Encode(), Until: until.Encode()}, TableDef: tm[0], Embedded: addresses}
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			Expect(q).To(ContainSubstring("SELECT DISTINCT [CustomerId], NULL from cdc.[fn_cdc_get_all_changes_dbo_Addresses] ( @from_lsn, @to_lsn, N'all' )"))
+			Expect(q).NotTo(ContainSubstring("min_lsn"))
+			g.Assert(args).Equal([]any{since.Lsn, until.Lsn})
+		})
+	})
+}
+
+func TestNewQuery_WithFilters(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when a read has filters and fields", func() {
+		tm := []*conf.TableMapping{
+			{
+				TableName: "Customers",
+				ColumnMappings: []*conf.ColumnMapping{
+					{FieldName: "Id", IsIdColumn: true},
+					{FieldName: "Country", PropertyName: "ns0:country"},
+					{FieldName: "Revenue"},
+					{FieldName: "Name"},
+				},
+			},
+			{
+				TableName:      "Orders",
+				ChangeTracking: true,
+				ColumnMappings: []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}, {FieldName: "Status"}},
+			},
+			{
+				TableName:      "Invoices",
+				CDCEnabled:     true,
+				ColumnMappings: []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}, {FieldName: "Total"}},
+			},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: tm,
+		}
+		country, _ := ParseFilter("country", "in.(NO,SE)")
+		from, _ := ParseFilter("Revenue", "gte.100")
+		to, _ := ParseFilter("Revenue", "lt.200")
+
+		g.It("should parse the operator and values", func() {
+			g.Assert(country).Equal(Filter{Property: "country", Op: "in", Values: []string{"NO", "SE"}})
+			_, err := ParseFilter("Revenue", "like.1%")
+			g.Assert(errors.Is(err, ErrInvalidRequest)).IsTrue()
+		})
+
+		g.It("should bind the filters as parameters", func() {
+			query := NewQuery(DatasetRequest{Limit: 10, Filters: []Filter{country, from, to}}, tm[0], layer)
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[Customers] WHERE [Country] IN (@p2, @p3) AND [Revenue] >= @p4 AND [Revenue] < @p5")
+			g.Assert(args).Equal([]any{int64(10), "NO", "SE", "100", "200"})
+		})
+
+		g.It("should read the fields and the id column", func() {
+			query := NewQuery(DatasetRequest{Entities: true, From: NewCursor("INT", int64(5)).Encode(), Fields: []string{"Name"}, Filters: []Filter{country}}, tm[0], layer)
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT t.[Id], t.[Name] FROM [dbo].[Customers] AS t WHERE [Id] > @p1 AND t.[Country] IN (@p2, @p3) ORDER BY [Id]")
+			g.Assert(args).Equal([]any{int64(5), "NO", "SE"})
+		})
+
+		g.It("should always read deletes from change tracking", func() {
+			status, _ := ParseFilter("Status", "eq.open")
+			query := NewQuery(DatasetRequest{Since: EncodeVersion(41), Filters: []Filter{status}, Fields: []string{"Status"}}, tm[1], layer)
+			q, _, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT t.[Id], t.[Status], ct.[Id], ct.SYS_CHANGE_VERSION AS [__$sys_change_version], CAST(ct.SYS_CHANGE_OPERATION AS varchar(1)) AS [__$sys_change_operation] " +
+				"FROM CHANGETABLE(CHANGES [dbo].[Orders], @p1) AS ct LEFT OUTER JOIN [dbo].[Orders] AS t ON t.[Id] = ct.[Id] WHERE (ct.SYS_CHANGE_OPERATION = 'D' OR (t.[Status] = @p2)) ORDER BY ct.SYS_CHANGE_VERSION")
+		})
+
+		g.It("should read the change columns of a cdc read", func() {
+			since := CDCToken{Lsn: []byte{0, 0, 0, 0x2a, 0, 0, 0, 0x10, 0, 0x01}}
+			query := NewQuery(DatasetRequest{Since: since.Encode(), Fields: []string{"Total"}}, tm[2], layer)
+			q, _, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			Expect(q).To(ContainSubstring("SELECT t.[Id], t.[Total], t.[__$start_lsn], t.[__$seqval], t.[__$operation], t.[__$update_mask] from cdc.[fn_cdc_get_all_changes_dbo_Invoices]"))
+		})
+
+		g.It("should reject properties that are not mapped", func() {
+			_, _, err := NewQuery(DatasetRequest{Fields: []string{"Secret"}}, tm[0], layer).BuildQuery()
+			g.Assert(errors.Is(err, ErrInvalidRequest)).IsTrue()
+		})
+	})
+
+	g.Describe("when a table has a hierarchyid column", func() {
+		tm := []*conf.TableMapping{
+			{
+				TableName:      "Employees",
+				ColumnMappings: []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}, {FieldName: "Name"}, {FieldName: "Node"}},
+			},
+			{
+				TableName:      "Employees",
+				ChangeTracking: true,
+				ColumnMappings: []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}},
+			},
+			{
+				TableName:      "Employees",
+				CDCEnabled:     true,
+				ColumnMappings: []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}},
+			},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: tm,
+		}
+		columns := []*CatalogColumn{{Name: "Id", Type: "int"}, {Name: "Name", Type: "nvarchar"}, {Name: "Node", Type: "hierarchyid"}}
+
+		g.It("should read the path of the column", func() {
+			q, _, err := NewQuery(DatasetRequest{Columns: columns}, tm[0], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT t.[Id], t.[Name], t.[Node].ToString() AS [Node] FROM [dbo].[Employees] AS t")
+		})
+
+		g.It("should read the path of a selected field", func() {
+			q, _, err := NewQuery(DatasetRequest{Columns: columns, Fields: []string{"Node"}}, tm[0], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT t.[Id], t.[Node].ToString() AS [Node] FROM [dbo].[Employees] AS t")
+		})
+
+		g.It("should read the table as it is without such a column", func() {
+			q, _, err := NewQuery(DatasetRequest{Columns: columns[:2]}, tm[0], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT * FROM [dbo].[Employees]")
+		})
+
+		g.It("should read the path from change tracking", func() {
+			q, _, err := NewQuery(DatasetRequest{Since: EncodeVersion(41), Columns: columns}, tm[1], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			Expect(q).To(HavePrefix("SELECT t.[Id], t.[Name], t.[Node].ToString() AS [Node], ct.[Id]"))
+		})
+
+		g.It("should read the path of a captured column from cdc", func() {
+			since := CDCToken{Lsn: []byte{0, 0, 0, 0x2a, 0, 0, 0, 0x10, 0, 0x01}}
+			capture := &CaptureInstance{Name: "dbo_Employees", Columns: []string{"Id", "Node"}}
+			q, _, err := NewQuery(DatasetRequest{Since: since.Encode(), Columns: columns, Capture: capture}, tm[2], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			Expect(q).To(ContainSubstring("SELECT t.[Id], t.[Node].ToString() AS [Node], t.[__$start_lsn], t.[__$seqval], t.[__$operation], t.[__$update_mask] from cdc.[fn_cdc_get_all_changes_dbo_Employees]"))
+
+			capture.Columns = nil
+			q, _, err = NewQuery(DatasetRequest{Since: since.Encode(), Columns: columns, Capture: capture}, tm[2], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			Expect(q).To(ContainSubstring("SELECT * from cdc.[fn_cdc_get_all_changes_dbo_Employees]"))
+		})
+	})
+
+	g.Describe("when a table has an sql_variant column", func() {
+		table := &conf.TableMapping{
+			TableName:      "Settings",
+			ColumnMappings: []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}, {FieldName: "Value"}},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: []*conf.TableMapping{table},
+		}
+		columns := []*CatalogColumn{{Name: "Id", Type: "int"}, {Name: "Value", Type: "sql_variant"}}
+
+		g.It("should read decimals as floats and guids as text by their base type", func() {
+			q, _, err := NewQuery(DatasetRequest{Columns: columns}, table, layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT t.[Id], CASE WHEN SQL_VARIANT_PROPERTY(t.[Value], 'BaseType') = 'uniqueidentifier' THEN CAST(LOWER(CONVERT(char(36), t.[Value])) AS sql_variant)" +
+				" WHEN SQL_VARIANT_PROPERTY(t.[Value], 'BaseType') IN ('decimal', 'numeric') THEN CAST(CAST(t.[Value] AS float) AS sql_variant)" +
+				" WHEN SQL_VARIANT_PROPERTY(t.[Value], 'BaseType') IN ('money', 'smallmoney') THEN CAST(CAST(t.[Value] AS float) AS sql_variant)" +
+				" ELSE t.[Value] END AS [Value] FROM [dbo].[Settings] AS t")
+		})
+
+		g.It("should read exact decimals as their text", func() {
+			exact := *table
+			exact.ExactDecimals = true
+			q, _, err := NewQuery(DatasetRequest{Columns: columns}, &exact, layer).BuildQuery()
+			g.Assert(err).IsNil()
+			Expect(q).To(ContainSubstring("IN ('decimal', 'numeric') THEN CAST(CONVERT(varchar(50), t.[Value]) AS sql_variant)"))
+			Expect(q).To(ContainSubstring("IN ('money', 'smallmoney') THEN CAST(CONVERT(varchar(50), CAST(t.[Value] AS money), 2) AS sql_variant)"))
+		})
+	})
+
+	g.Describe("when a table has spatial columns", func() {
+		table := &conf.TableMapping{
+			TableName:      "Places",
+			ColumnMappings: []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}},
+			Columns:        map[string]*conf.ColumnMapping{"Area": {FieldName: "Area", SpatialFormat: "geojson"}},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: []*conf.TableMapping{table},
+		}
+		columns := []*CatalogColumn{{Name: "Id", Type: "int"}, {Name: "Location", Type: "geography"}, {Name: "Area", Type: "geometry"}}
+
+		g.It("should read well-known text, or GeoJSON with the arcs made lines", func() {
+			q, _, err := NewQuery(DatasetRequest{Columns: columns}, table, layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT t.[Id], t.[Location].STAsText() AS [Location], t.[Area].STCurveToLine() AS [Area] FROM [dbo].[Places] AS t")
+		})
+	})
+}
+
+func TestNewQuery_WithProcedure(t *testing.T) {
+	g := goblin.Goblin(t)
+	RegisterFailHandler(func(m string, _ ...int) { g.Fail(m) })
+
+	g.Describe("when a dataset is read from a procedure", func() {
+		arguments := []*conf.ProcedureArgument{
+			{Name: "Region", Value: "north"},
+			{Name: "MinAmount", Type: "float", Source: "query", QueryParam: "min", Value: "0"},
+			{Name: "Changed", Type: "datetime", Source: "since"},
+			{Name: "MaxRows", Type: "int", Source: "limit"},
+		}
+		tm := []*conf.TableMapping{
+			{
+				TableName: "Orders",
+				Procedure: &conf.ProcedureMapping{
+					Name:           "GetOrders",
+					SinceParameter: "@Token",
+					Arguments:      arguments,
+				},
+			},
+			{
+				TableName: "Invoices",
+				Procedure: &conf.ProcedureMapping{
+					Name:      "InvoicesByRegion",
+					Function:  true,
+					Arguments: arguments[:2],
+				},
+			},
+		}
+		layer := &conf.Datalayer{
+			Schema:        "dbo",
+			TableMappings: tm,
+		}
+
+		g.It("should call the procedure with named arguments and the since parameter", func() {
+			request := DatasetRequest{
+				Since:  "2023-01-02T03:04:05Z",
+				Limit:  10,
+				Params: map[string]string{"min": "12.5"},
+			}
+			query := NewQuery(request, tm[0], layer)
+			Expect(query).Should(BeAssignableToTypeOf(ProcedureQuery{}))
+
+			q, args, err := query.BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("[dbo].[GetOrders]")
+			g.Assert(len(args)).Equal(5)
+			g.Assert(args[0]).Equal(sql.Named("Region", "north"))
+			g.Assert(args[1]).Equal(sql.Named("MinAmount", 12.5))
+			g.Assert(args[2]).Equal(sql.Named("Changed", civil.DateTimeOf(time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC))))
+			g.Assert(args[3]).Equal(sql.Named("MaxRows", int64(10)))
+			g.Assert(args[4].(sql.NamedArg).Name).Equal("Token")
+
+			since, ok := ProcedureSince(args)
+			g.Assert(ok).IsTrue()
+			g.Assert(since).Equal("2023-01-02T03:04:05Z")
+		})
+
+		g.It("should default missing arguments to the config value, or null", func() {
+			_, args, err := NewQuery(DatasetRequest{}, tm[0], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(args[1]).Equal(sql.Named("MinAmount", 0.0))
+			g.Assert(args[2]).Equal(sql.Named("Changed", nil))
+		})
+
+		g.It("should select from a function with positional arguments", func() {
+			q, args, err := NewQuery(DatasetRequest{Limit: 5}, tm[1], layer).BuildQuery()
+			g.Assert(err).IsNil()
+			g.Assert(q).Equal("SELECT TOP (@p1) * FROM [dbo].[InvoicesByRegion](@p2, @p3)")
+			g.Assert(args).Equal([]any{int64(5), "north", 0.0})
+
+			_, ok := ProcedureSince(args)
+			g.Assert(ok).IsFalse()
+		})
+
+		g.It("should describe the procedure and the function with null arguments", func() {
+			g.Assert(DescribeStatement(tm[0], layer)).Equal("EXEC [dbo].[GetOrders] @Region = NULL, @MinAmount = NULL, @Changed = NULL, @MaxRows = NULL, @Token = NULL")
+			g.Assert(DescribeStatement(tm[1], layer)).Equal("SELECT * FROM [dbo].[InvoicesByRegion](NULL, NULL)")
+		})
+
+		g.It("should reject invalid query parameters and filters", func() {
+			_, _, err := NewQuery(DatasetRequest{Params: map[string]string{"min": "lots"}}, tm[0], layer).BuildQuery()
+			g.Assert(errors.Is(err, ErrInvalidRequest)).IsTrue()
+
+			filter, _ := ParseFilter("Region", "eq.south")
+			_, _, err = NewQuery(DatasetRequest{Filters: []Filter{filter}}, tm[1], layer).BuildQuery()
+			g.Assert(errors.Is(err, ErrInvalidRequest)).IsTrue()
+		})
+	})
+}
@@ -0,0 +1,78 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+// RowVersionQuery reads the rows written after a rowversion. Every insert and update gives a
+// row a new rowversion, unique in the database, so the rows can be paged exactly by it. The
+// read is bounded by the Until token, taken from MIN_ACTIVE_ROWVERSION() before the read, so a
+// transaction still running when the read starts is picked up by the next one. A limited first
+// read, without a token, is paged by rowversion from the start.
+type RowVersionQuery struct {
+	Datalayer *conf.Datalayer
+	Request   DatasetRequest
+	TableDef  *conf.TableMapping
+}
+
+func (q RowVersionQuery) BuildQuery() (string, []any, error) {
+	tableName := TableName(q.Datalayer.GetSchema(q.TableDef), q.TableDef.TableName)
+	column := QuoteName(q.TableDef.RowVersionColumn)
+
+	args := params{}
+	limit := ""
+	if q.Request.Limit > 0 {
+		limit = fmt.Sprintf("TOP (%s) ", args.add(q.Request.Limit))
+	}
+	columns, alias, err := RequestColumns(q.Request, q.TableDef, q.Datalayer)
+	if err != nil {
+		return "", nil, err
+	}
+	predicates := make([]string, 0, 3)
+	if q.Request.Since != "" {
+		since, ok := DecodeRowVersion(q.Request.Since)
+		if !ok {
+			return "", nil, fmt.Errorf("invalid rowversion token %q", q.Request.Since)
+		}
+		predicates = append(predicates, fmt.Sprintf("%s > %s", column, args.add(since)))
+	}
+	if until, ok := DecodeRowVersion(q.Request.Until); ok {
+		predicates = append(predicates, fmt.Sprintf("%s <= %s", column, args.add(until)))
+	}
+	filters, err := filterPredicates(q.Request, q.TableDef, &args, columnPrefix(alias))
+	if err != nil {
+		return "", nil, err
+	}
+	if filters != "" {
+		predicates = append(predicates, filters)
+	}
+
+	query := fmt.Sprintf("SELECT %s%s FROM %s%s%s ORDER BY %s", limit, columns, tableName, alias, whereClause(predicates), column)
+	return query, args, nil
+}
+
+// RowVersionOf returns the binary form of a rowversion read as a bigint.
+func RowVersionOf(version int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(version))
+	return b
+}
+
+// EncodeRowVersion returns a rowversion as a continuation token, the url safe base64 encoding
+// of its hex literal.
+func EncodeRowVersion(version []byte) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("0x%x", version)))
+}
+
+// DecodeRowVersion reads a token created by EncodeRowVersion.
+func DecodeRowVersion(token string) ([]byte, bool) {
+	data, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, false
+	}
+	return decodeBinary(string(data), 8)
+}
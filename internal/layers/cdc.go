@@ -0,0 +1,99 @@
+package layers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
+)
+
+// ErrTokenExpired is returned when the changes after a continuation token have been removed by
+// the CDC cleanup job. The client has to start over with a full read of the dataset.
+var ErrTokenExpired = errors.New("continuation token is older than the retained change history, a full resync is required")
+
+// checkTokenExpiry compares the since token with the lowest lsn left in the change table.
+func (l *Layer) checkTokenExpiry(capture *db.CaptureInstance, since string) error {
+	token, ok := db.DecodeCDCToken(since)
+	if !ok {
+		return nil
+	}
+	var minLsn []byte
+	row := l.Repo.DB.QueryRowContext(l.Repo.ctx, "SELECT sys.fn_cdc_get_min_lsn(@p1)", capture.Name)
+	if err := row.Scan(&minLsn); err != nil {
+		return err
+	}
+	if token.Expired(minLsn) {
+		return fmt.Errorf("%w: token is at 0x%x, capture instance %s starts at 0x%x", ErrTokenExpired, token.Lsn, capture.Name, minLsn)
+	}
+	return nil
+}
+
+// captureInstance resolves the change table to continue a cdc read from. It lists the capture
+// instances of the source table in cdc.change_tables, found through the configured instance or
+// the table name, and lets db.SelectCaptureInstance pick one. If the metadata cannot be read,
+// the configured instance is used as is. If no instance reaches back to the token,
+// ErrTokenExpired is returned.
+func (l *Layer) captureInstance(tableDef *conf.TableMapping, since string) (*db.CaptureInstance, error) {
+	name := db.CaptureInstanceName(tableDef)
+
+	rows, err := l.Repo.DB.QueryContext(l.Repo.ctx, `
+		SELECT capture_instance, supports_net_changes, start_lsn, captured_column_list FROM cdc.change_tables
+		WHERE source_object_id IN (
+			SELECT source_object_id FROM cdc.change_tables WHERE capture_instance = @p1
+			UNION SELECT OBJECT_ID(@p2))
+		ORDER BY create_date`, name, db.TableName(db.CDCSchema(tableDef), tableDef.TableName))
+	if err != nil {
+		l.er(err)
+		return &db.CaptureInstance{Name: name}, nil
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	instances := make([]*db.CaptureInstance, 0)
+	for rows.Next() {
+		ci := &db.CaptureInstance{}
+		var columnList sql.NullString
+		if err := rows.Scan(&ci.Name, &ci.SupportsNetChanges, &ci.StartLsn, &columnList); err != nil {
+			l.er(err)
+			return &db.CaptureInstance{Name: name}, nil
+		}
+		if columnList.Valid {
+			ci.Columns = db.ParseColumnList(columnList.String)
+		}
+		instances = append(instances, ci)
+	}
+	if err := rows.Err(); err != nil {
+		l.er(err)
+		return &db.CaptureInstance{Name: name}, nil
+	}
+	if len(instances) == 0 {
+		l.logger.Warnf("capture instance %s not found in cdc.change_tables", name)
+	}
+
+	capture, ok := db.SelectCaptureInstance(name, instances, since)
+	if !ok {
+		return nil, fmt.Errorf("%w: no capture instance of %s reaches back to the token", ErrTokenExpired, tableDef.TableName)
+	}
+	if capture.Name != name {
+		l.logger.Infof("reading changes of %s from capture instance %s instead of %s", tableDef.TableName, capture.Name, name)
+	}
+	if tableDef.CDCNetChanges && !capture.SupportsNetChanges {
+		l.logger.Warnf("capture instance %s does not support net changes, reading all changes", capture.Name)
+	}
+	return capture, nil
+}
+
+// cdcOperation returns the __$operation of a change row, or 0 if the row has none.
+func cdcOperation(rowType []interface{}, cols []string) int64 {
+	for i, col := range cols {
+		if col == "__$operation" {
+			if op, ok := rowType[i].(*sql.NullInt64); ok && op.Valid {
+				return op.Int64
+			}
+		}
+	}
+	return 0
+}
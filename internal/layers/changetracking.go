@@ -0,0 +1,33 @@
+package layers
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
+)
+
+// checkVersionExpiry compares the since token with the oldest change tracking version that is
+// still retained for the table. Reading from an older version silently misses changes.
+func (l *Layer) checkVersionExpiry(tableDef *conf.TableMapping, since string) error {
+	version, ok := db.DecodeVersion(since)
+	if !ok {
+		return nil // rejected when the query is built
+	}
+	tableName := db.TableName(l.cmgr.Datalayer.GetSchema(tableDef), tableDef.TableName)
+
+	var minVersion sql.NullInt64
+	row := l.Repo.DB.QueryRowContext(l.Repo.ctx, "SELECT CHANGE_TRACKING_MIN_VALID_VERSION(OBJECT_ID(@p1))", tableName)
+	if err := row.Scan(&minVersion); err != nil {
+		l.er(err)
+		return nil
+	}
+	if !minVersion.Valid {
+		return fmt.Errorf("change tracking is not enabled for %s", tableName)
+	}
+	if version < minVersion.Int64 {
+		return fmt.Errorf("%w: token is at version %d, %s is tracked from version %d", ErrTokenExpired, version, tableName, minVersion.Int64)
+	}
+	return nil
+}
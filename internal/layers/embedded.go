@@ -0,0 +1,285 @@
+package layers
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
+)
+
+// embedBatchSize is the number of parents the embedded entities are read for at a time. The
+// keys are bound as parameters, and a statement can have no more than 2100 of them.
+const embedBatchSize = 500
+
+// embedder holds back the entities of a read until the embedded entities of a batch of them
+// have been read, and then hands them on in the order they were read. A table without embedded
+// entities has its entities handed on right away.
+type embedder struct {
+	layer    *Layer
+	tableDef *conf.TableMapping
+	colTypes []*sql.ColumnType
+	indexes  []int // column of the parent key of each embedded entity
+	pending  []*Entity
+	keys     [][]any // parent key of each embedded entity, for each pending entity
+	callBack func(*Entity)
+}
+
+func (l *Layer) newEmbedder(tableDef *conf.TableMapping, cols []string, colTypes []*sql.ColumnType, callBack func(*Entity)) *embedder {
+	e := &embedder{
+		layer:    l,
+		tableDef: tableDef,
+		colTypes: colTypes,
+		callBack: callBack,
+	}
+	for _, embedded := range tableDef.EmbeddedEntities {
+		column := parentColumn(tableDef, embedded)
+		index := slices.Index(cols, column)
+		if index < 0 {
+			l.logger.Warnf("column %s of %s is not read, %s can not be embedded", column, tableDef.TableName, embedded.TableName)
+		}
+		e.indexes = append(e.indexes, index)
+	}
+	return e
+}
+
+// add queues an entity, and the parent keys of its row. Deleted entities get no embedded entities.
+func (e *embedder) add(entity *Entity, row []interface{}) error {
+	if len(e.indexes) == 0 {
+		e.callBack(entity)
+		return nil
+	}
+	keys := make([]any, len(e.indexes))
+	if !entity.IsDeleted {
+		for i, index := range e.indexes {
+			if index < 0 {
+				continue
+			}
+			if value, ok := keyValue(row[index], e.colTypes[index].DatabaseTypeName()); ok {
+				keys[i] = value
+			}
+		}
+	}
+	e.pending = append(e.pending, entity)
+	e.keys = append(e.keys, keys)
+	if len(e.pending) >= embedBatchSize {
+		return e.flush()
+	}
+	return nil
+}
+
+// flush reads the embedded entities of the queued entities, and hands them on.
+func (e *embedder) flush() error {
+	for i, embedded := range e.tableDef.EmbeddedEntities {
+		keys := make([]any, 0, len(e.pending))
+		seen := make(map[string]bool)
+		for _, k := range e.keys {
+			if k[i] != nil && !seen[fmt.Sprint(k[i])] {
+				seen[fmt.Sprint(k[i])] = true
+				keys = append(keys, k[i])
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		children, err := e.layer.embeddedEntities(e.tableDef, embedded, keys)
+		if err != nil {
+			return err
+		}
+		name := embedded.PropertyName
+		if name == "" {
+			name = "ns0:" + embedded.TableName
+		}
+		for j, entity := range e.pending {
+			if e.keys[j][i] == nil {
+				continue
+			}
+			entities := children[fmt.Sprint(e.keys[j][i])]
+			if entities == nil {
+				entities = []*Entity{}
+			}
+			entity.Properties[name] = entities
+		}
+	}
+	for _, entity := range e.pending {
+		e.callBack(entity)
+	}
+	e.pending = e.pending[:0]
+	e.keys = e.keys[:0]
+	return nil
+}
+
+// embeddedEntities reads the rows of an embedded entity that point at a batch of parents,
+// grouped by the parent key they point at.
+func (l *Layer) embeddedEntities(tableDef *conf.TableMapping, embedded *conf.EmbeddedEntity, keys []any) (map[string][]*Entity, error) {
+	child := embedded.TableMapping(tableDef)
+	query, args, err := db.KeyedQuery{
+		Datalayer: l.cmgr.Datalayer,
+		TableDef:  child,
+		Column:    embedded.ForeignKey,
+		Keys:      keys,
+		Request:   db.DatasetRequest{Columns: l.tableColumns(child)},
+	}.BuildQuery()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := l.Repo.DB.QueryContext(l.Repo.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	cols, _ := rows.Columns()
+	colTypes, _ := rows.ColumnTypes()
+	index := slices.Index(cols, embedded.ForeignKey)
+	if index < 0 {
+		return nil, fmt.Errorf("foreign key %s not found in %s", embedded.ForeignKey, embedded.TableName)
+	}
+	row := buildRowType(cols, colTypes, child)
+
+	children := make(map[string][]*Entity)
+	for rows.Next() {
+		if err := rows.Scan(row...); err != nil {
+			return nil, err
+		}
+		key, ok := keyValue(row[index], colTypes[index].DatabaseTypeName())
+		if !ok {
+			continue
+		}
+		entity, err := l.toEntity(row, cols, colTypes, child)
+		if err != nil {
+			return nil, err
+		}
+		children[fmt.Sprint(key)] = append(children[fmt.Sprint(key)], entity)
+	}
+	return children, rows.Err()
+}
+
+// emitChangedParents emits the parents of the embedded entities that changed in the range of a
+// change read again, in their current state. A cdc read looks for changes in the change tables
+// of cdc enabled embedded entities, other reads by the since column of embedded entities that
+// have one. The highest since value of the changed rows is returned, for the continuation token.
+func (l *Layer) emitChangedParents(request db.DatasetRequest, tableDef *conf.TableMapping, cdc bool, callBack func(*Entity)) (*time.Time, error) {
+	var lastSince *time.Time
+	for _, embedded := range tableDef.EmbeddedEntities {
+		if (cdc && !embedded.CDCEnabled) || (!cdc && embedded.SinceColumn == "") {
+			continue
+		}
+		if cdc {
+			// the child changes after the token may be cleaned up while the parent ones are kept
+			capture := &db.CaptureInstance{Name: db.CaptureInstanceName(embedded.TableMapping(tableDef))}
+			if err := l.checkTokenExpiry(capture, request.Since); err != nil {
+				return nil, err
+			}
+		}
+		query, args, err := db.EmbeddedChangesQuery{
+			Datalayer: l.cmgr.Datalayer,
+			Request:   request,
+			TableDef:  tableDef,
+			Embedded:  embedded,
+			SinceType: l.sinceType(embedded.TableMapping(tableDef), embedded.SinceColumn),
+		}.BuildQuery()
+		if err != nil {
+			return nil, err
+		}
+		keys, since, err := l.changedKeys(query, args, embedded.TableMapping(tableDef))
+		if err != nil {
+			return nil, err
+		}
+		if since != nil && (lastSince == nil || since.After(*lastSince)) {
+			lastSince = since
+		}
+		for start := 0; start < len(keys); start += embedBatchSize {
+			batch := keys[start:min(start+embedBatchSize, len(keys))]
+			if err := l.emitParents(request, tableDef, parentColumn(tableDef, embedded), batch, callBack); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return lastSince, nil
+}
+
+// changedKeys reads the foreign keys, and the highest since value, returned by an EmbeddedChangesQuery.
+func (l *Layer) changedKeys(query string, args []any, child *conf.TableMapping) ([]any, *time.Time, error) {
+	rows, err := l.Repo.DB.QueryContext(l.Repo.ctx, query, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	cols, _ := rows.Columns()
+	colTypes, _ := rows.ColumnTypes()
+	row := buildRowType(cols, colTypes, child)
+
+	keys := make([]any, 0)
+	var lastSince *time.Time
+	for rows.Next() {
+		if err := rows.Scan(row...); err != nil {
+			return nil, nil, err
+		}
+		if key, ok := keyValue(row[0], colTypes[0].DatabaseTypeName()); ok {
+			keys = append(keys, key)
+		}
+		if since, ok := row[1].(*sql.NullTime); ok && since.Valid && (lastSince == nil || since.Time.After(*lastSince)) {
+			lastSince = &since.Time
+		}
+	}
+	return keys, lastSince, rows.Err()
+}
+
+// emitParents reads a batch of parents by key from their table, with their embedded entities.
+// The filters and fields of the request apply to them as to the rest of the read.
+func (l *Layer) emitParents(request db.DatasetRequest, tableDef *conf.TableMapping, column string, keys []any, callBack func(*Entity)) error {
+	query, args, err := db.KeyedQuery{
+		Datalayer: l.cmgr.Datalayer,
+		TableDef:  tableDef,
+		Column:    column,
+		Keys:      keys,
+		Request:   request,
+	}.BuildQuery()
+	if err != nil {
+		return err
+	}
+	rows, err := l.Repo.DB.QueryContext(l.Repo.ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	cols, _ := rows.Columns()
+	colTypes, _ := rows.ColumnTypes()
+	row := buildRowType(cols, colTypes, tableDef)
+	embed := l.newEmbedder(tableDef, cols, colTypes, callBack)
+	for rows.Next() {
+		if err := rows.Scan(row...); err != nil {
+			return err
+		}
+		entity, err := l.toEntity(row, cols, colTypes, tableDef)
+		if err != nil {
+			return err
+		}
+		if err := embed.add(entity, row); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return embed.flush()
+}
+
+// parentColumn is the column of the parent table the foreign key of an embedded entity points at.
+func parentColumn(tableDef *conf.TableMapping, embedded *conf.EmbeddedEntity) string {
+	if embedded.ParentColumn != "" {
+		return embedded.ParentColumn
+	}
+	return tableDef.IdColumn()
+}
@@ -0,0 +1,57 @@
+package layers
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+// BuildEntityId fills the named key columns of an entity id constructor. Every value is path
+// escaped, so a "/" in a key can not be mistaken for the separator between two of them.
+func BuildEntityId(constructor string, values map[string]string) (string, error) {
+	var missing []string
+	id := conf.EntityIdPlaceholder.ReplaceAllStringFunc(constructor, func(placeholder string) string {
+		column := placeholder[1 : len(placeholder)-1]
+		value, ok := values[column]
+		if !ok || value == "" {
+			missing = append(missing, column)
+			return ""
+		}
+		return url.PathEscape(value)
+	})
+	if missing != nil {
+		return "", fmt.Errorf("no value for key columns %s", strings.Join(missing, ", "))
+	}
+	return id, nil
+}
+
+// DecomposeEntityId reads the key column values back out of an id made by BuildEntityId. The
+// constructor is matched against the end of the id, so any base uri or namespace prefix is
+// allowed in front of it.
+func DecomposeEntityId(constructor string, id string) (map[string]string, error) {
+	columns := conf.KeyColumns(constructor)
+	pattern := ""
+	for i, literal := range conf.EntityIdPlaceholder.Split(constructor, -1) {
+		pattern += regexp.QuoteMeta(literal)
+		if i < len(columns) {
+			pattern += "([^/]+)"
+		}
+	}
+	match := regexp.MustCompile(pattern + "$").FindStringSubmatch(id)
+	if match == nil {
+		return nil, fmt.Errorf("entity id %s does not match %s", id, constructor)
+	}
+
+	values := make(map[string]string, len(columns))
+	for i, column := range columns {
+		value, err := url.PathUnescape(match[i+1])
+		if err != nil {
+			return nil, fmt.Errorf("entity id %s has an invalid %s: %w", id, column, err)
+		}
+		values[column] = value
+	}
+	return values, nil
+}
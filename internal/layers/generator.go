@@ -0,0 +1,215 @@
+package layers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
+)
+
+// GenerateConfig builds a configuration for the tables of a set of schemas, or for the named
+// tables in them, from the catalog views of the database the layer is connected to. It is a
+// starting point to edit, and holds no user or password.
+func (l *Layer) GenerateConfig(schemas []string, tables []string) (*conf.Datalayer, error) {
+	if l.cmgr.Datalayer == nil {
+		return nil, fmt.Errorf("no configuration loaded to connect with")
+	}
+	if err := l.EnsureConnection(&conf.TableMapping{}); err != nil {
+		return nil, err
+	}
+	if len(schemas) == 0 {
+		schemas = []string{defaultSchema(l.cmgr.Datalayer.Schema)}
+	}
+
+	columns, err := db.Catalog(l.Repo.DB, schemas, tables)
+	if err != nil {
+		return nil, err
+	}
+	fks := make(map[string][]*db.ForeignKey)
+	for _, c := range columns {
+		key := c.Schema + "." + c.Table
+		if _, ok := fks[key]; ok {
+			continue
+		}
+		fks[key], err = db.ForeignKeys(l.Repo.DB, c.Schema, c.Table)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return generateConfig(l.cmgr.Datalayer, columns, fks), nil
+}
+
+// generateConfig makes a table mapping and a post mapping of every table in the catalog.
+//   - the primary key columns are the id columns, and make the entity id constructor
+//   - a foreign key to the primary key of another table of the catalog becomes a reference to its
+//     entities, or is left to foreignKeyReferences if it has more than one column. A foreign key
+//     to other columns is not a reference
+//   - cdc, change tracking and rowversion columns are used to read changes, in that order
+//   - every column that can be written gets a field mapping with its data type
+//   - the datasets of tables outside the default schema are named schema.table
+func generateConfig(current *conf.Datalayer, columns []*db.CatalogColumn, fks map[string][]*db.ForeignKey) *conf.Datalayer {
+	config := &conf.Datalayer{
+		Id:             current.Id,
+		DatabaseServer: current.DatabaseServer,
+		BaseUri:        current.BaseUri,
+		Database:       current.Database,
+		Port:           current.Port,
+		Schema:         current.Schema,
+		BaseNameSpace:  current.BaseNameSpace,
+		Instance:       current.Instance,
+		TimeZone:       current.TimeZone,
+		TableMappings:  make([]*conf.TableMapping, 0),
+		PostMappings:   make([]*conf.PostMapping, 0),
+	}
+
+	// the columns of each table, in the order of the catalog
+	order := make([]string, 0)
+	tables := make(map[string][]*db.CatalogColumn)
+	for _, c := range columns {
+		key := c.Schema + "." + c.Table
+		if _, ok := tables[key]; !ok {
+			order = append(order, key)
+		}
+		tables[key] = append(tables[key], c)
+	}
+
+	// the primary key of every table, and the entity id constructor of every table with a single
+	// column primary key, for references to it
+	keys := make(map[string][]string)
+	templates := make(map[string]string)
+	for key, cols := range tables {
+		pk := primaryKey(cols)
+		keys[strings.ToLower(key)] = pk
+		if len(pk) == 1 {
+			templates[strings.ToLower(key)] = config.BaseUri + entityIdConstructor(cols[0].Table, pk)
+		}
+	}
+
+	for _, key := range order {
+		cols := tables[key]
+		table := cols[0]
+		pk := primaryKey(cols)
+
+		tableDef := &conf.TableMapping{
+			TableName:           table.Table,
+			EntityIdConstructor: entityIdConstructor(table.Table, pk),
+			Types:               []string{},
+			ColumnMappings:      make([]*conf.ColumnMapping, 0, len(cols)),
+		}
+		post := &conf.PostMapping{
+			DatasetName:   table.Table,
+			TableName:     table.Table,
+			Query:         "upsertBulk",
+			FieldMappings: make([]*conf.FieldMapping, 0, len(cols)),
+		}
+		if table.Schema != defaultSchema(config.Schema) {
+			// a table of another schema is named after it, so tables of the same name in two
+			// schemas do not end up as the same dataset
+			schema := table.Schema
+			tableDef.DatasetName = schema + "." + table.Table
+			tableDef.Config = &conf.TableConfig{Schema: &schema}
+			post.DatasetName = tableDef.DatasetName
+			post.Config = &conf.TableConfig{Schema: &schema}
+		}
+		if len(pk) == 1 && !identity(cols, pk[0]) {
+			// an auto incrementing key can not be written, so it is left out
+			post.IdColumn = pk[0]
+		} else if len(pk) > 1 {
+			post.EntityIdConstructor = tableDef.EntityIdConstructor
+		}
+
+		references := make(map[string]string)
+		for _, fk := range fks[key] {
+			target := strings.ToLower(fk.ReferencedSchema + "." + fk.ReferencedTable)
+			// the ids of a table are made from its primary key, a key to other columns can not make them
+			if _, ok := alignColumns(keys[target], fk.ReferencedColumns); !ok {
+				continue
+			}
+			if template, ok := templates[target]; ok && len(fk.Columns) == 1 {
+				references[fk.Columns[0]] = template
+			} else {
+				tableDef.ForeignKeyReferences = true
+			}
+		}
+
+		switch {
+		case table.CDCEnabled:
+			tableDef.CDCEnabled = true
+		case table.ChangeTracking && len(pk) > 0:
+			tableDef.ChangeTracking = true
+		}
+		for _, c := range cols {
+			cm := &conf.ColumnMapping{
+				FieldName:  c.Name,
+				IsIdColumn: c.PrimaryKey,
+			}
+			if template, ok := references[c.Name]; ok {
+				cm.IsReference = true
+				cm.ReferenceTemplate = template
+			}
+			tableDef.ColumnMappings = append(tableDef.ColumnMappings, cm)
+
+			if strings.EqualFold(c.Type, "timestamp") {
+				if !tableDef.CDCEnabled && !tableDef.ChangeTracking {
+					tableDef.RowVersionColumn = c.Name
+				}
+				continue
+			}
+			// the database fills these in itself
+			if c.Computed || c.Identity {
+				continue
+			}
+			post.FieldMappings = append(post.FieldMappings, &conf.FieldMapping{
+				FieldName: c.Name,
+				SortOrder: len(post.FieldMappings) + 1,
+				DataType:  c.DataType(),
+			})
+		}
+
+		config.TableMappings = append(config.TableMappings, tableDef)
+		config.PostMappings = append(config.PostMappings, post)
+	}
+	return config
+}
+
+// primaryKey returns the primary key columns of a table.
+func primaryKey(cols []*db.CatalogColumn) []string {
+	var pk []string
+	for _, c := range cols {
+		if c.PrimaryKey {
+			pk = append(pk, c.Name)
+		}
+	}
+	return pk
+}
+
+// identity reports whether a column is an identity column.
+func identity(cols []*db.CatalogColumn, name string) bool {
+	for _, c := range cols {
+		if c.Name == name {
+			return c.Identity
+		}
+	}
+	return false
+}
+
+// entityIdConstructor makes ids in a namespace named after the table, from the primary key.
+func entityIdConstructor(table string, pk []string) string {
+	switch len(pk) {
+	case 0:
+		return ""
+	case 1:
+		return strings.ToLower(table) + "/%s"
+	default:
+		return strings.ToLower(table) + "/{" + strings.Join(pk, "}/{") + "}"
+	}
+}
+
+// defaultSchema is the schema of a table when none is configured.
+func defaultSchema(schema string) string {
+	if schema == "" {
+		return "dbo"
+	}
+	return schema
+}
@@ -0,0 +1,95 @@
+package layers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+)
+
+// expandJSON parses a column holding a JSON document. With parseJson the document replaces the
+// text of the property, and every json path lifts a value out of it into a property or reference
+// of its own. Numbers are kept as their text, so large integers come through unchanged.
+func expandJSON(entity *Entity, property string, text string, colMapping *conf.ColumnMapping) error {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+	decoder.UseNumber()
+	var doc any
+	if err := decoder.Decode(&doc); err != nil {
+		return fmt.Errorf("column %s does not hold JSON: %w", colMapping.FieldName, err)
+	}
+
+	if colMapping.ParseJson {
+		entity.Properties[property] = doc
+	}
+	for _, pm := range colMapping.JsonPaths {
+		value, ok := jsonPath(doc, pm.Path)
+		if !ok || value == nil {
+			continue
+		}
+		name := pm.PropertyName
+		if name == "" {
+			segments := strings.Split(strings.TrimPrefix(pm.Path, "$."), ".")
+			name = "ns0:" + strings.Split(segments[len(segments)-1], "[")[0]
+		}
+		if pm.IsReference {
+			entity.References[name] = fmt.Sprintf(pm.ReferenceTemplate, value)
+		} else {
+			entity.Properties[name] = value
+		}
+	}
+	return nil
+}
+
+// jsonPath looks up a value in a parsed JSON document by a path of object keys and array
+// indexes, like "$.address.city" or "lines[0].sku".
+func jsonPath(doc any, path string) (any, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return doc, true
+	}
+	current := doc
+	for _, segment := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(segment, "[")
+		if key != "" {
+			object, ok := current.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if current, ok = object[key]; !ok {
+				return nil, false
+			}
+		}
+		for rest != "" {
+			index, after, found := strings.Cut(rest, "]")
+			if !found {
+				return nil, false
+			}
+			i, err := strconv.Atoi(index)
+			array, ok := current.([]any)
+			if err != nil || !ok || i < 0 || i >= len(array) {
+				return nil, false
+			}
+			current = array[i]
+			rest = strings.TrimPrefix(after, "[")
+		}
+	}
+	return current, true
+}
+
+// jsonText returns a nested property posted for a JSON column as the document to write. Other
+// values are written as their text.
+func jsonText(value interface{}) (string, error) {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	default:
+		return fmt.Sprintf("%s", value), nil
+	}
+}
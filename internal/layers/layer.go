@@ -6,6 +6,8 @@ import (
 	"encoding/base64"
 	"fmt"
 	"reflect"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -36,6 +38,12 @@ type Repository struct {
 	ctx      context.Context
 	tableDef *conf.TableMapping
 	digest   [16]byte
+	// foreign keys of the tables with foreignKeyReferences, read when the configuration is loaded
+	foreignKeys map[*conf.TableMapping][]*foreignKeyReference
+	// data types of the since columns of the tables and embedded entities, see sinceType
+	sinceTypes map[string]string
+	// columns of the tables and embedded entities read without a custom query, see tableColumns
+	columns map[string][]*db.CatalogColumn
 }
 
 type DatasetRequest struct {
@@ -78,7 +86,7 @@ func NewLayer(lc fx.Lifecycle, cmgr *conf.ConfigurationManager, env *conf.Env, s
 func (l *Layer) GetDatasetNames() []string {
 	names := make([]string, 0)
 	for _, table := range l.cmgr.Datalayer.TableMappings {
-		names = append(names, table.TableName)
+		names = append(names, table.Dataset())
 	}
 	return names
 }
@@ -86,18 +94,18 @@ func (l *Layer) GetDatasetNames() []string {
 func (l *Layer) GetDatasetEndpoints() []DatasetName {
 	names := make([]DatasetName, 0)
 	for _, table := range l.cmgr.Datalayer.TableMappings {
-		names = append(names, DatasetName{Name: table.TableName, Type: []string{"GET"}})
+		names = append(names, DatasetName{Name: table.Dataset(), Type: []string{"GET"}})
 	}
 	for _, table := range l.cmgr.Datalayer.PostMappings {
 		found := false
 		for i, dataset := range names {
-			if dataset.Name == table.TableName {
+			if dataset.Name == table.Dataset() {
 				names[i].Type = append(names[i].Type, "POST")
 				found = true
 			}
 		}
 		if !found {
-			names = append(names, DatasetName{Name: table.TableName, Type: []string{"POST"}})
+			names = append(names, DatasetName{Name: table.Dataset(), Type: []string{"POST"}})
 		}
 	}
 	// TODO: support listing dataset that only handle post
@@ -106,7 +114,7 @@ func (l *Layer) GetDatasetEndpoints() []DatasetName {
 
 func (l *Layer) GetTableDefinition(datasetName string) *conf.TableMapping {
 	for _, table := range l.cmgr.Datalayer.TableMappings {
-		if table.TableName == datasetName {
+		if table.Dataset() == datasetName {
 			return table
 		}
 	}
@@ -152,23 +160,76 @@ func (l *Layer) ChangeSet(request db.DatasetRequest, callBack func(*Entity)) err
 		return nil
 	}
 
-	if tableDef.CustomQuery != "" {
-		if !strings.Contains(tableDef.CustomQuery, "%s") {
-			l.logger.Error("custom query defined, but missing required '%s' for limit injection")
-			return nil
+	err := l.EnsureConnection(tableDef)
+	if err != nil {
+		return err
+	}
+
+	if err := l.checkSoftDelete(tableDef); err != nil {
+		l.er(err)
+		return err
+	}
+	if tableDef.Procedure != nil {
+		return l.procedureChangeSet(request, tableDef, tags, callBack)
+	}
+
+	// the first read of a change tracking or cdc dataset is of the table, in no order, and the
+	// token is the end of the change set. it can not be cut short, so it is read in full
+	if request.Since == "" && !request.Entities && tableDef.RowVersionColumn == "" && (tableDef.ChangeTracking || tableDef.CDCEnabled) {
+		request.Limit = 0
+	}
+
+	// an entities read is paged by its key, or by a query template with an offset. any other
+	// read can not say where a page ended, and a page cut short would look like the last one
+	template := tableDef.Template()
+	if request.Entities && !(tableDef.CustomQuery == "" && len(tableDef.IdColumns()) > 0) && !(template != nil && template.Uses("offset")) {
+		request.Limit = 0
+	}
+
+	// a since column token is taken from the rows read, so it can not run ahead of them. a full
+	// read of the entities reads them all, and takes the highest value in the table before the read
+	sinceColumn := tableDef.SinceColumn != "" && tableDef.RowVersionColumn == ""
+	since := request.Since
+	if !sinceColumn || request.Entities {
+		since, _ = getSince(l.Repo.DB, tableDef, l.cmgr.Datalayer.GetSchema(tableDef))
+	}
+	if sinceColumn {
+		request.SinceType = l.sinceType(tableDef, tableDef.SinceColumn)
+	}
+	request.Columns = l.tableColumns(tableDef)
+	if tableDef.RowVersionColumn != "" {
+		request.Until = since
+	} else if tableDef.ChangeTracking {
+		request.Until = since
+		if request.Since != "" {
+			if err := l.checkVersionExpiry(tableDef, request.Since); err != nil {
+				l.er(err)
+				return err
+			}
+		}
+	} else if tableDef.CDCEnabled {
+		request.Until = since
+		if request.Since != "" {
+			request.Capture, err = l.captureInstance(tableDef, request.Since)
+			if err != nil {
+				l.er(err)
+				return err
+			}
+			if err := l.checkTokenExpiry(request.Capture, request.Since); err != nil {
+				l.er(err)
+				return err
+			}
 		}
 	}
 
-	err := l.EnsureConnection(tableDef)
+	query, args, err := db.NewQuery(request, tableDef, l.cmgr.Datalayer).BuildQuery()
 	if err != nil {
+		l.er(err)
 		return err
 	}
 
-	query := db.NewQuery(request, tableDef, l.cmgr.Datalayer)
-
 	var rows *sql.Rows
-	since, _ := getSince(l.Repo.DB, tableDef)
-	rows, err = l.Repo.DB.QueryContext(l.Repo.ctx, query.BuildQuery())
+	rows, err = l.Repo.DB.QueryContext(l.Repo.ctx, query, args...)
 
 	if err != nil {
 		l.er(err)
@@ -182,7 +243,73 @@ func (l *Layer) ChangeSet(request db.DatasetRequest, callBack func(*Entity)) err
 	colTypes, _ := rows.ColumnTypes()
 
 	// set up the row interface from the returned types
-	nullableRowData := buildRowType(cols, colTypes)
+	nullableRowData := buildRowType(cols, colTypes, tableDef)
+
+	// entities are paged by key, so remember where the last row left off
+	var keyIndexes []int
+	if request.Entities && request.Limit > 0 && tableDef.CustomQuery == "" {
+		for _, column := range tableDef.IdColumns() {
+			keyIndexes = append(keyIndexes, slices.Index(cols, column))
+		}
+	}
+	var cursor *db.Cursor
+	read := int64(0)
+
+	// a query template with an offset is paged by the number of rows read
+	offset := int64(-1)
+	if request.Entities && request.Limit > 0 && template != nil && template.Uses("offset") {
+		offset, _ = db.Offset(request.From)
+	}
+
+	// a limited cdc read continues from the last change it emitted
+	lsnIndex, seqvalIndex := -1, -1
+	if tableDef.CDCEnabled && request.Since != "" && request.Limit > 0 {
+		for i, col := range cols {
+			switch col {
+			case "__$start_lsn":
+				lsnIndex = i
+			case "__$seqval":
+				seqvalIndex = i
+			}
+		}
+	}
+	var lastChange *db.CDCToken
+
+	// and so does a limited change tracking read, from the last version
+	versionIndex := -1
+	if tableDef.ChangeTracking && request.Since != "" && request.Limit > 0 {
+		for i, col := range cols {
+			if col == "__$sys_change_version" {
+				versionIndex = i
+			}
+		}
+	}
+	lastVersion := int64(-1)
+
+	// and a limited rowversion read, from the last rowversion
+	rowVersionIndex := -1
+	if tableDef.RowVersionColumn != "" && !request.Entities && request.Limit > 0 {
+		for i, col := range cols {
+			if col == tableDef.RowVersionColumn {
+				rowVersionIndex = i
+			}
+		}
+	}
+	var lastRowVersion []byte
+
+	// and a since column read, from the highest since value
+	sinceIndex := -1
+	if sinceColumn {
+		for i, col := range cols {
+			if col == tableDef.SinceColumn {
+				sinceIndex = i
+			}
+		}
+	}
+	var lastSince *time.Time
+
+	// entities with embedded entities are handed on in batches, once those have been read
+	embed := l.newEmbedder(tableDef, cols, colTypes, callBack)
 
 	for rows.Next() {
 		err = rows.Scan(nullableRowData...)
@@ -192,21 +319,50 @@ func (l *Layer) ChangeSet(request db.DatasetRequest, callBack func(*Entity)) err
 		} else {
 			// map it
 			_ = l.statsd.Incr("mssql.read", tags, 1)
+			read++
+			if keyIndexes != nil {
+				if next := keyCursor(nullableRowData, colTypes, keyIndexes); next != nil {
+					cursor = next
+				}
+			}
+			if lsnIndex >= 0 {
+				lastChange = &db.CDCToken{
+					Lsn: append([]byte(nil), *nullableRowData[lsnIndex].(*sql.RawBytes)...),
+				}
+				// net changes have no seqval, and are paged by whole lsns
+				if seqvalIndex >= 0 {
+					lastChange.Seqval = append([]byte(nil), *nullableRowData[seqvalIndex].(*sql.RawBytes)...)
+				}
+			}
+			if versionIndex >= 0 {
+				if version, err := toInt64(*nullableRowData[versionIndex].(*sql.RawBytes)); err == nil {
+					lastVersion = version
+				}
+			}
+			if rowVersionIndex >= 0 {
+				if rv, ok := nullableRowData[rowVersionIndex].(*sql.RawBytes); ok && *rv != nil {
+					lastRowVersion = append([]byte(nil), *rv...)
+				}
+			}
+			if sinceIndex >= 0 {
+				// custom queries are not ordered by the since column, so keep the highest value
+				if value, ok := nullableRowData[sinceIndex].(*sql.NullTime); ok && value.Valid && (lastSince == nil || value.Time.After(*lastSince)) {
+					lastSince = &value.Time
+				}
+			}
+			if tableDef.CDCEnabled && cdcOperation(nullableRowData, cols) == 3 {
+				// the before image of an update is not a state of the entity, the after image follows it
+				continue
+			}
 			entity, err := l.toEntity(nullableRowData, cols, colTypes, tableDef)
 			if err != nil {
 				return err
 			}
 			if entity != nil {
-				// add types to entity
-				if len(tableDef.Types) == 1 {
-					entity.References["rdf:type"] = tableDef.Types[0]
-				} else if len(tableDef.Types) > 1 {
-					// multiple types...
-					// fix me
+				if err := embed.add(entity, nullableRowData); err != nil {
+					l.er(err)
+					return err
 				}
-
-				// call back function
-				callBack(entity)
 			}
 		}
 	}
@@ -233,8 +389,81 @@ func (l *Layer) ChangeSet(request db.DatasetRequest, callBack func(*Entity)) err
 		}
 	}
 
+	if err := embed.flush(); err != nil {
+		l.er(err)
+		return err
+	}
+
+	if request.Entities {
+		// the change token to read /changes from after the full read was taken before its first page
+		if request.From != "" {
+			if from, err := db.DecodeCursor(request.From); err == nil {
+				since = from.Since
+			}
+		}
+		// a full page means there may be more to read, a short page is the last one
+		if offset >= 0 {
+			cursor = db.NewCursor("BIGINT", offset+read)
+		}
+		if cursor != nil && read == request.Limit {
+			cursor.Since = since
+			entity := NewEntity()
+			entity.ID = "@continuation"
+			entity.Properties["token"] = cursor.Encode()
+
+			callBack(entity)
+		} else if hasChangeToken(tableDef) && since != "" {
+			entity := NewEntity()
+			entity.ID = "@continuation"
+			entity.Properties["token"] = since
+
+			callBack(entity)
+		}
+		return nil
+	}
+
+	// a full page may have stopped short of the end of the change set. cdc pages are read
+	// with ties, so they can hold a few more rows than the limit
+	if lastChange != nil && read >= request.Limit {
+		since = lastChange.Encode()
+	}
+	if lastVersion >= 0 && read >= request.Limit {
+		since = db.EncodeVersion(lastVersion)
+	}
+	if lastRowVersion != nil && read >= request.Limit {
+		since = db.EncodeRowVersion(lastRowVersion)
+	}
+	if lastSince != nil {
+		since = db.EncodeSince(*lastSince)
+	}
+
+	// parents are emitted again when their embedded entities changed in the range read. that
+	// range ends at the last row of a full page, and at the end of the change set otherwise
+	if _, ok := db.DecodeCDCToken(request.Since); (ok && tableDef.CDCEnabled && request.Until != "") || (sinceColumn && request.Since != "") {
+		changes := request
+		changes.Until = ""
+		if sinceColumn {
+			if lastSince != nil && request.Limit > 0 && read >= request.Limit {
+				changes.Until = since
+			}
+		} else {
+			changes.Until = request.Until
+			if lastChange != nil && read >= request.Limit {
+				changes.Until = lastChange.Encode()
+			}
+		}
+		childSince, err := l.emitChangedParents(changes, tableDef, !sinceColumn, callBack)
+		if err != nil {
+			l.er(err)
+			return err
+		}
+		if childSince != nil && (lastSince == nil || childSince.After(*lastSince)) {
+			since = db.EncodeSince(*childSince)
+		}
+	}
+
 	// only add continuation token if enabled or sinceColumn is set
-	if tableDef.CDCEnabled || tableDef.SinceColumn != "" {
+	if hasChangeToken(tableDef) {
 		entity := NewEntity()
 		entity.ID = "@continuation"
 		entity.Properties["token"] = since
@@ -246,7 +475,13 @@ func (l *Layer) ChangeSet(request db.DatasetRequest, callBack func(*Entity)) err
 	return nil
 }
 
-func buildRowType(cols []string, colTypes []*sql.ColumnType) []interface{} {
+// hasChangeToken reports whether the changes of a dataset are read from a continuation token.
+func hasChangeToken(tableDef *conf.TableMapping) bool {
+	template := tableDef.Template()
+	return tableDef.CDCEnabled || tableDef.ChangeTracking || tableDef.SinceColumn != "" || tableDef.RowVersionColumn != "" || (template != nil && template.Uses("since"))
+}
+
+func buildRowType(cols []string, colTypes []*sql.ColumnType, tableDef *conf.TableMapping) []interface{} {
 	nullableRowData := make([]interface{}, len(cols))
 	for i := range cols {
 		colDef := colTypes[i]
@@ -255,14 +490,24 @@ func buildRowType(cols []string, colTypes []*sql.ColumnType) []interface{} {
 		switch ctType {
 		case "INT", "SMALLINT", "TINYINT":
 			nullableRowData[i] = new(sql.NullInt64)
-		case "VARCHAR", "NVARCHAR", "TEXT", "NTEXT", "CHAR":
+		case "VARCHAR", "NVARCHAR", "TEXT", "NTEXT", "CHAR", "NCHAR", "XML":
 			nullableRowData[i] = new(sql.NullString)
-		case "DATETIME", "DATE", "DATETIME2":
+		case "DATETIME", "DATE", "DATETIME2", "SMALLDATETIME", "DATETIMEOFFSET", "TIME":
 			nullableRowData[i] = new(sql.NullTime)
-		case "MONEY", "DECIMAL", "FLOAT":
+		case "MONEY", "SMALLMONEY", "DECIMAL":
+			if tableDef.ExactDecimal(cols[i]) {
+				// the driver reads these as their decimal text, which a float64 would round
+				nullableRowData[i] = new(sql.NullString)
+			} else {
+				nullableRowData[i] = new(sql.NullFloat64)
+			}
+		case "FLOAT", "REAL":
 			nullableRowData[i] = new(sql.NullFloat64)
 		case "BIT":
 			nullableRowData[i] = new(sql.NullBool)
+		case "SQL_VARIANT":
+			// the driver hands back the value in the type it was stored with
+			nullableRowData[i] = new(any)
 		default:
 			nullableRowData[i] = new(sql.RawBytes)
 		}
@@ -287,10 +532,142 @@ func (l *Layer) EnsureConnection(table *conf.TableMapping) error {
 		}
 		l.Repo.DB = db
 		l.Repo.digest = l.cmgr.State.Digest
+		l.Repo.foreignKeys = l.loadForeignKeys()
+		l.Repo.sinceTypes = l.loadSinceTypes()
+		l.Repo.columns = l.loadColumns()
 	}
 	return nil
 }
 
+// loadColumns reads the columns of the tables and embedded entities read without a custom
+// query, so the ones that have to be converted to be held in an entity are selected converted.
+// Tables the metadata can not be read for are read as they are.
+func (l *Layer) loadColumns() map[string][]*db.CatalogColumn {
+	var schemas, tables []string
+	mappings := make([]*conf.TableMapping, 0)
+	add := func(tableDef *conf.TableMapping) {
+		if tableDef.CustomQuery != "" || tableDef.Procedure != nil {
+			return
+		}
+		schema := defaultSchema(l.cmgr.Datalayer.GetSchema(tableDef))
+		if !slices.Contains(schemas, schema) {
+			schemas = append(schemas, schema)
+		}
+		if !slices.Contains(tables, tableDef.TableName) {
+			tables = append(tables, tableDef.TableName)
+		}
+		mappings = append(mappings, tableDef)
+	}
+	for _, tableDef := range l.cmgr.Datalayer.TableMappings {
+		add(tableDef)
+		for _, embedded := range tableDef.EmbeddedEntities {
+			add(embedded.TableMapping(tableDef))
+		}
+	}
+
+	columns := make(map[string][]*db.CatalogColumn)
+	if len(mappings) == 0 {
+		return columns
+	}
+	catalog, err := db.Catalog(l.Repo.DB, schemas, tables)
+	if err != nil {
+		l.logger.Warnf("could not read the columns of the tables: %s", err)
+		return columns
+	}
+	for _, tableDef := range mappings {
+		key := l.tableKey(tableDef)
+		if _, ok := columns[key]; ok {
+			continue
+		}
+		schema := defaultSchema(l.cmgr.Datalayer.GetSchema(tableDef))
+		for _, column := range catalog {
+			if column.Schema == schema && column.Table == tableDef.TableName {
+				columns[key] = append(columns[key], column)
+			}
+		}
+	}
+	return columns
+}
+
+// checkSoftDelete rejects a soft delete column that needs a softDeleteValue before any row of its
+// table is read, see conf.TableMapping.ValidateSoftDelete.
+func (l *Layer) checkSoftDelete(tableDef *conf.TableMapping) error {
+	for _, column := range l.tableColumns(tableDef) {
+		if column.Name == tableDef.SoftDeleteColumn {
+			return tableDef.ValidateSoftDelete(column.Type)
+		}
+	}
+	return nil
+}
+
+// tableColumns returns the columns of a table, as read by loadColumns, or nil if the table is
+// read with a custom query.
+func (l *Layer) tableColumns(tableDef *conf.TableMapping) []*db.CatalogColumn {
+	if tableDef.CustomQuery != "" || tableDef.Procedure != nil {
+		return nil
+	}
+	return l.Repo.columns[l.tableKey(tableDef)]
+}
+
+// loadSinceTypes reads the data types of the since columns of the tables and their embedded
+// entities, so a since token is compared in the type of the column it was read from. A column
+// the metadata can not be read for is compared as a datetime2.
+func (l *Layer) loadSinceTypes() map[string]string {
+	sinceTypes := make(map[string]string)
+	load := func(tableDef *conf.TableMapping, column string) {
+		if column == "" || tableDef.CustomQuery != "" {
+			return
+		}
+		schema := defaultSchema(l.cmgr.Datalayer.GetSchema(tableDef))
+		columnType, err := db.ColumnType(l.Repo.DB, schema, tableDef.TableName, column)
+		if err != nil {
+			l.logger.Warnf("could not read the type of %s in %s: %s", column, tableDef.TableName, err)
+			return
+		}
+		sinceTypes[l.sinceTypeKey(tableDef, column)] = columnType
+	}
+	for _, tableDef := range l.cmgr.Datalayer.TableMappings {
+		load(tableDef, tableDef.SinceColumn)
+		for _, embedded := range tableDef.EmbeddedEntities {
+			load(embedded.TableMapping(tableDef), embedded.SinceColumn)
+		}
+	}
+	return sinceTypes
+}
+
+// sinceType returns the data type of a since column, as read by loadSinceTypes.
+func (l *Layer) sinceType(tableDef *conf.TableMapping, column string) string {
+	return l.Repo.sinceTypes[l.sinceTypeKey(tableDef, column)]
+}
+
+func (l *Layer) sinceTypeKey(tableDef *conf.TableMapping, column string) string {
+	return l.tableKey(tableDef) + "." + db.QuoteName(column)
+}
+
+func (l *Layer) tableKey(tableDef *conf.TableMapping) string {
+	schema := defaultSchema(l.cmgr.Datalayer.GetSchema(tableDef))
+	return db.TableName(schema, tableDef.TableName)
+}
+
+// loadForeignKeys reads the foreign keys of the tables that have their references made from
+// them. A table the metadata can not be read for gets no references from it.
+func (l *Layer) loadForeignKeys() map[*conf.TableMapping][]*foreignKeyReference {
+	foreignKeys := make(map[*conf.TableMapping][]*foreignKeyReference)
+	for _, tableDef := range l.cmgr.Datalayer.TableMappings {
+		if !tableDef.ForeignKeyReferences {
+			continue
+		}
+		schema := defaultSchema(l.cmgr.Datalayer.GetSchema(tableDef))
+		fks, err := db.ForeignKeys(l.Repo.DB, schema, tableDef.TableName)
+		if err != nil {
+			l.logger.Warnf("could not read the foreign keys of %s: %s", tableDef.TableName, err)
+			continue
+		}
+		foreignKeys[tableDef] = resolveForeignKeys(l.cmgr.Datalayer, fks)
+	}
+	return foreignKeys
+}
+
 func (l *Layer) connect(table *conf.TableMapping) (*sql.DB, error) {
 
 	u := l.cmgr.Datalayer.GetUrl(table)
@@ -312,6 +689,13 @@ func (l *Layer) connect(table *conf.TableMapping) (*sql.DB, error) {
 func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.ColumnType, tableDef *conf.TableMapping) (*Entity, error) {
 	entity := NewEntity()
 	log := l.logger.With("table", tableDef.TableName)
+	keyColumns := conf.KeyColumns(tableDef.EntityIdConstructor)
+	keys := make(map[string]string, len(keyColumns))
+
+	// add types to entity
+	for _, t := range tableDef.Types {
+		addType(entity, t)
+	}
 	for i, raw := range rowType {
 		if raw != nil {
 			ct := colTypes[i]
@@ -320,9 +704,39 @@ func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.C
 			colMapping := tableDef.Columns[colName]
 			colName = "ns0:" + colName
 
+			if strings.HasPrefix(cols[i], db.ChildReferencesColumn) {
+				index, err := strconv.Atoi(strings.TrimPrefix(cols[i], db.ChildReferencesColumn))
+				if err != nil || index >= len(tableDef.ChildReferences) {
+					continue
+				}
+				child := tableDef.ChildReferences[index]
+				name := child.PropertyName
+				if name == "" {
+					name = "ns0:" + child.TableName
+				}
+				entity.References[name] = []string{}
+				// an entity without children gets no rows, and so a null
+				if children := raw.(*sql.NullString); children.Valid {
+					refs, err := childReferences(children.String, child)
+					if err != nil {
+						log.Warnf("Error reading child references: %v", err)
+					} else {
+						entity.References[name] = refs
+					}
+				}
+				continue
+			}
+
 			var val interface{} = nil
 			var strVal = ""
 
+			if colName == "ns0:__$sys_change_operation" {
+				ptrToNullString := raw.(*sql.NullString)
+				if (*ptrToNullString).Valid && (*ptrToNullString).String == "D" {
+					entity.IsDeleted = true
+				}
+			}
+
 			if colName == "ns0:__$operation" {
 				ptrToNullInt := raw.(*sql.NullInt64)
 				if (*ptrToNullInt).Valid {
@@ -333,6 +747,16 @@ func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.C
 				}
 			}
 
+			if cols[i] == tableDef.SoftDeleteColumn {
+				// the columns of a custom query are only known once it is read
+				if err := tableDef.ValidateSoftDelete(ctName); err != nil {
+					return nil, err
+				}
+				if softDeleted(raw, ctName, tableDef.SoftDeleteValue) {
+					entity.IsDeleted = true
+				}
+			}
+
 			if colMapping != nil {
 				if colMapping.IgnoreColumn {
 					continue
@@ -351,7 +775,7 @@ func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.C
 			entity.Properties[colName] = nil
 
 			switch ctName {
-			case "VARCHAR", "NVARCHAR", "TEXT", "NTEXT", "CHAR":
+			case "VARCHAR", "NVARCHAR", "TEXT", "NTEXT", "CHAR", "NCHAR", "XML":
 				ptrToNullString := raw.(*sql.NullString)
 				if (*ptrToNullString).Valid {
 					val = (*ptrToNullString).String
@@ -365,7 +789,7 @@ func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.C
 					strVal = uid.String()
 					entity.Properties[colName] = strVal
 				}
-			case "DATETIME", "DATE", "DATETIME2":
+			case "DATETIME", "DATE", "DATETIME2", "SMALLDATETIME":
 				ptrToNullDatetime := raw.(*sql.NullTime)
 				if (*ptrToNullDatetime).Valid {
 					val = (*ptrToNullDatetime).Time
@@ -392,6 +816,17 @@ func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.C
 					}
 					entity.Properties[colName] = val.(time.Time).Format(time.RFC3339Nano)
 				}
+			case "DATETIMEOFFSET":
+				// the offset is part of the value, so it is kept rather than moved to a time zone
+				ptrToNullDatetime := raw.(*sql.NullTime)
+				if (*ptrToNullDatetime).Valid {
+					entity.Properties[colName] = (*ptrToNullDatetime).Time.Format(time.RFC3339Nano)
+				}
+			case "TIME":
+				ptrToNullDatetime := raw.(*sql.NullTime)
+				if (*ptrToNullDatetime).Valid {
+					entity.Properties[colName] = (*ptrToNullDatetime).Time.Format(timeOfDay)
+				}
 			case "INT", "SMALLINT", "TINYINT":
 				ptrToNullInt := raw.(*sql.NullInt64)
 				if (*ptrToNullInt).Valid {
@@ -410,10 +845,38 @@ func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.C
 						entity.Properties[colName] = val
 					}
 				}
-			case "MONEY", "DECIMAL", "FLOAT":
-				ptrToNullFloat := raw.(*sql.NullFloat64)
-				if (*ptrToNullFloat).Valid {
-					entity.Properties[colName] = (*ptrToNullFloat).Float64
+			case "MONEY", "SMALLMONEY", "DECIMAL", "FLOAT", "REAL":
+				switch v := raw.(type) {
+				case *sql.NullString:
+					if v.Valid {
+						entity.Properties[colName] = v.String
+					}
+				case *sql.NullFloat64:
+					if v.Valid {
+						entity.Properties[colName] = v.Float64
+					}
+				}
+			case "BINARY", "VARBINARY", "IMAGE", "HIERARCHYID":
+				ptrToBytes := raw.(*sql.RawBytes)
+				if *ptrToBytes != nil {
+					entity.Properties[colName] = base64.StdEncoding.EncodeToString(*ptrToBytes)
+				}
+			case "GEOGRAPHY", "GEOMETRY":
+				ptrToBytes := raw.(*sql.RawBytes)
+				if *ptrToBytes != nil {
+					g, err := decodeSpatial(*ptrToBytes, ctName == "GEOGRAPHY")
+					if err != nil {
+						log.Warnf("Error decoding %s for %s: %v", ctName, colName, err)
+					} else if colMapping != nil && colMapping.SpatialFormat == "geojson" {
+						entity.Properties[colName] = g.GeoJSON()
+					} else {
+						entity.Properties[colName] = g.WKT()
+					}
+				}
+			case "SQL_VARIANT":
+				ptrToAny := raw.(*any)
+				if *ptrToAny != nil {
+					entity.Properties[colName] = variantValue(*ptrToAny)
 				}
 			case "BIT":
 				ptrToNullBool := raw.(*sql.NullBool)
@@ -426,19 +889,65 @@ func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.C
 				log.Errorf("Got: %s for %s", ctName, colName)
 			}
 
+			if strVal != "" {
+				keys[cols[i]] = strVal
+			}
+
 			if colMapping != nil {
 				// is this the id column
-				if colMapping.IsIdColumn && strVal != "" {
+				if colMapping.IsIdColumn && strVal != "" && keyColumns == nil {
 					entity.ID = l.cmgr.Datalayer.BaseUri + fmt.Sprintf(tableDef.EntityIdConstructor, strVal)
 				}
 
 				if colMapping.IsReference && strVal != "" {
-					entity.References[colName] = fmt.Sprintf(colMapping.ReferenceTemplate, strVal)
+					if colMapping.ReferenceDelimiter != "" {
+						entity.References[colName] = delimitedReferences(strVal, colMapping.ReferenceDelimiter, colMapping.ReferenceTemplate)
+					} else {
+						entity.References[colName] = fmt.Sprintf(colMapping.ReferenceTemplate, strVal)
+					}
+				}
+
+				// a discriminator column tells which kind of entity the row holds
+				if t, ok := colMapping.TypeMap[strVal]; ok && strVal != "" {
+					addType(entity, t)
+				}
+
+				if (colMapping.ParseJson || len(colMapping.JsonPaths) > 0) && strVal != "" {
+					if err := expandJSON(entity, colName, strVal, colMapping); err != nil {
+						log.Warnf("Error expanding JSON: %v", err)
+					}
 				}
 			}
 		}
 	}
 
+	// references from the foreign keys of the table, unless the column is mapped by hand
+	if l.Repo != nil {
+		for _, ref := range l.Repo.foreignKeys[tableDef] {
+			name := "ns0:" + ref.columns[0]
+			if colMapping := tableDef.Columns[ref.columns[0]]; colMapping != nil {
+				if colMapping.IsReference || colMapping.IgnoreColumn {
+					continue
+				}
+				if colMapping.PropertyName != "" {
+					name = colMapping.PropertyName
+				}
+			}
+			if id, ok := ref.reference(l.cmgr.Datalayer.BaseUri, keys); ok {
+				entity.References[name] = id
+			}
+		}
+	}
+
+	if keyColumns != nil {
+		id, err := BuildEntityId(tableDef.EntityIdConstructor, keys)
+		if err != nil {
+			log.Errorf("could not build entity id: %s", err)
+		} else {
+			entity.ID = l.cmgr.Datalayer.BaseUri + id
+		}
+	}
+
 	if entity.ID == "" { // this is invalid
 		log.Errorf("empty id value from the database, this is probably pretty wrong. CDC access? entity: %+v", entity)
 		return nil, fmt.Errorf("empty id value from the database. CDC access?")
@@ -447,41 +956,147 @@ func (l *Layer) toEntity(rowType []interface{}, cols []string, colTypes []*sql.C
 	return entity, nil
 }
 
-// serverSince queries the server for its time, this will be used as the source of the since to return
-// when using cdc. The return value is Base64 encoded
-
-func getSince(db *sql.DB, tableDef *conf.TableMapping) (string, error) {
-	s := ""
-	if tableDef.SinceColumn != "" {
-		var dt time.Time
-		row := db.QueryRow(fmt.Sprintf("SELECT MAX(%s) from %s", tableDef.SinceColumn, tableDef.TableName))
-		err := row.Scan(&dt)
+// getSince returns the change token of a table as it is now, the token to read /changes from
+// after reading the table in full. For a since column it is the highest value in the column,
+// and for a table without change tracking the time of the server.
+func getSince(sqlDB *sql.DB, tableDef *conf.TableMapping, schema string) (string, error) {
+	if tableDef.RowVersionColumn != "" {
+		// rowversions below MIN_ACTIVE_ROWVERSION() are committed, the one before it is the last safe to read
+		row := sqlDB.QueryRow("SELECT CAST(MIN_ACTIVE_ROWVERSION() AS bigint) - 1")
+		var version int64
+		err := row.Scan(&version)
 		if err != nil {
 			return "", err
 		}
-		s = fmt.Sprintf("%s", dt.Format("2006-01-02T15:04:05.000Z"))
+		return db.EncodeRowVersion(db.RowVersionOf(version)), nil
+	} else if tableDef.SinceColumn != "" {
+		row := sqlDB.QueryRow(fmt.Sprintf("SELECT MAX(%s) FROM %s", db.QuoteName(tableDef.SinceColumn), db.TableName(defaultSchema(schema), tableDef.TableName)))
+		var since sql.NullTime
+		err := row.Scan(&since)
+		if err != nil {
+			return "", err
+		}
+		// an empty table has no token, and the next read of its changes is a full read
+		if !since.Valid {
+			return "", nil
+		}
+		return db.EncodeSince(since.Time), nil
+	} else if tableDef.ChangeTracking {
+		row := sqlDB.QueryRow("SELECT CHANGE_TRACKING_CURRENT_VERSION()")
+		var version sql.NullInt64
+		err := row.Scan(&version)
+		if err != nil {
+			return "", err
+		}
+		if !version.Valid {
+			return "", fmt.Errorf("change tracking is not enabled for the database")
+		}
+		return db.EncodeVersion(version.Int64), nil
 	} else if tableDef.CDCEnabled {
 		query := "select sys.fn_cdc_get_max_lsn();"
-		row := db.QueryRow(query)
+		row := sqlDB.QueryRow(query)
 		var bytes []byte
 		err := row.Scan(&bytes)
 		if err != nil {
 			return "", err
 		}
-		hexString := fmt.Sprintf("0x%x", bytes)
-		res := base64.RawURLEncoding.EncodeToString([]byte(hexString))
-		return res, nil
-	} else {
-		var dt time.Time
-		row := db.QueryRow("SELECT GETDATE()")
-		err := row.Scan(&dt)
-		if err != nil {
-			return "", err
+		return db.CDCToken{Lsn: bytes}.Encode(), nil
+	}
+	var dt time.Time
+	row := sqlDB.QueryRow("SELECT GETDATE()")
+	err := row.Scan(&dt)
+	if err != nil {
+		return "", err
+	}
+	return db.EncodeSince(dt), nil
+}
+
+// addType adds an rdf:type reference to an entity. A single type is kept as a string, and more
+// than one as a list.
+func addType(entity *Entity, t string) {
+	switch types := entity.References["rdf:type"].(type) {
+	case string:
+		if types != t {
+			entity.References["rdf:type"] = []string{types, t}
 		}
-		s = fmt.Sprintf("%s", dt.Format(time.RFC3339))
+	case []string:
+		if !slices.Contains(types, t) {
+			entity.References["rdf:type"] = append(types, t)
+		}
+	default:
+		entity.References["rdf:type"] = t
 	}
-	return base64.StdEncoding.EncodeToString([]byte(s)), nil
 }
+
+// timeOfDay is the form a TIME column is returned in, with as many fractional digits as needed.
+const timeOfDay = "15:04:05.9999999"
+
+// decimalPattern matches the text form of a decimal, as the driver hands back decimal and money values.
+var decimalPattern = regexp.MustCompile(`^-?[0-9]+(\.[0-9]+)?$`)
+
+// variantValue returns an SQL_VARIANT value in the JSON form of the type it was stored with.
+// Decimal, money and uniqueidentifier values are converted by their base type when they are
+// selected, see db.selectColumn, so the bytes left are those of a binary value.
+func variantValue(value any) any {
+	switch v := value.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	default:
+		return v
+	}
+}
+
+// keyCursor creates the cursor of a row from its key columns, or returns nil if one of them
+// was not read or is null.
+func keyCursor(rowData []interface{}, colTypes []*sql.ColumnType, keyIndexes []int) *db.Cursor {
+	types := make([]string, 0, len(keyIndexes))
+	values := make([]any, 0, len(keyIndexes))
+	for _, i := range keyIndexes {
+		if i < 0 {
+			return nil
+		}
+		value, ok := keyValue(rowData[i], colTypes[i].DatabaseTypeName())
+		if !ok {
+			return nil
+		}
+		types = append(types, colTypes[i].DatabaseTypeName())
+		values = append(values, value)
+	}
+	return db.NewKeyCursor(types, values)
+}
+
+// keyValue reads a scanned id column value in the form expected by db.NewCursor.
+func keyValue(raw interface{}, ctName string) (any, bool) {
+	switch v := raw.(type) {
+	case *sql.NullInt64:
+		return v.Int64, v.Valid
+	case *sql.NullString:
+		return v.String, v.Valid
+	case *sql.NullTime:
+		return v.Time, v.Valid
+	case *sql.RawBytes:
+		if *v == nil {
+			return nil, false
+		}
+		switch ctName {
+		case "UNIQUEIDENTIFIER":
+			var uid mssql.UniqueIdentifier
+			if err := uid.Scan([]byte(*v)); err != nil {
+				return nil, false
+			}
+			return uid.String(), true
+		case "BIGINT":
+			val, err := toInt64(*v)
+			return val, err == nil
+		default:
+			return string(*v), true
+		}
+	}
+	return nil, false
+}
+
 func toInt64(payload sql.RawBytes) (int64, error) {
 	content := reflect.ValueOf(payload).Interface().(sql.RawBytes)
 	data := string(content)                  //convert to string
@@ -494,7 +1109,11 @@ func toInt64(payload sql.RawBytes) (int64, error) {
 }
 
 func ignoreColumn(column string, tableDef *conf.TableMapping) bool {
-	if tableDef.CDCEnabled && strings.HasPrefix(column, "__$") {
+	if (tableDef.CDCEnabled || tableDef.ChangeTracking) && strings.HasPrefix(column, "__$") {
+		return true
+	}
+	// the rowversion is only there to page by
+	if tableDef.RowVersionColumn != "" && column == tableDef.RowVersionColumn {
 		return true
 	}
 	return false
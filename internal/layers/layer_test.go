@@ -1,10 +1,25 @@
 package layers
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"go.uber.org/zap"
 
 	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
 )
 
 func TestLayer_GetDatasetNames(t *testing.T) {
@@ -62,6 +77,50 @@ func TestLayer_GetTableDefinition(t *testing.T) {
 	}
 }
 
+func TestLayer_DatasetName(t *testing.T) {
+	tm := []*conf.TableMapping{
+		{
+			TableName: "Customers",
+		},
+		{
+			TableName:   "Customers",
+			DatasetName: "CustomersNorway",
+		},
+	}
+	pm := []*conf.PostMapping{
+		{
+			TableName:   "Customers",
+			DatasetName: "post.Customers",
+		},
+	}
+	layer := Layer{
+		cmgr: &conf.ConfigurationManager{
+			Datalayer: &conf.Datalayer{
+				TableMappings: tm,
+				PostMappings:  pm,
+			},
+		},
+	}
+
+	if tdef := layer.GetTableDefinition("CustomersNorway"); tdef != tm[1] {
+		t.Errorf("the dataset name should find the second mapping, got %+v", tdef)
+	}
+	endpoints := layer.GetDatasetEndpoints()
+	check := []DatasetName{
+		{Name: "Customers", Type: []string{"GET"}},
+		{Name: "CustomersNorway", Type: []string{"GET"}},
+		{Name: "post.Customers", Type: []string{"POST"}},
+	}
+	if !reflect.DeepEqual(endpoints, check) {
+		t.Errorf("%v != %v", endpoints, check)
+	}
+
+	tm[1].DatasetName = ""
+	if duplicates := layer.cmgr.Datalayer.DuplicateDatasets(); !reflect.DeepEqual(duplicates, []string{"Customers"}) {
+		t.Errorf("%v != [Customers]", duplicates)
+	}
+}
+
 func TestLayer_DoesDatasetExist(t *testing.T) {
 	tm := []*conf.TableMapping{
 		{
@@ -120,3 +179,701 @@ func TestLayer_GetContext(t *testing.T) {
 	}
 
 }
+
+func TestBuildEntityId(t *testing.T) {
+	constructor := "orderlines/{OrderId}/{LineNo}"
+
+	if columns := conf.KeyColumns(constructor); !reflect.DeepEqual(columns, []string{"OrderId", "LineNo"}) {
+		t.Errorf("%v != [OrderId LineNo]", columns)
+	}
+	if columns := conf.KeyColumns("customers/%s"); columns != nil {
+		t.Errorf("a format string should have no key columns, got %v", columns)
+	}
+
+	id, err := BuildEntityId(constructor, map[string]string{"OrderId": "A/1 2", "LineNo": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "orderlines/A%2F1%202/3" {
+		t.Errorf("%s != orderlines/A%%2F1%%202/3", id)
+	}
+
+	values, err := DecomposeEntityId(constructor, "http://data.test.io/test/"+id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, map[string]string{"OrderId": "A/1 2", "LineNo": "3"}) {
+		t.Errorf("%v does not hold the key values", values)
+	}
+
+	if _, err := BuildEntityId(constructor, map[string]string{"OrderId": "1"}); err == nil {
+		t.Errorf("a missing key value should fail")
+	}
+	if _, err := DecomposeEntityId(constructor, "ns3:customers/1"); err == nil {
+		t.Errorf("an id of another shape should fail")
+	}
+}
+
+func TestVariantValue(t *testing.T) {
+	offset := time.FixedZone("", 2*60*60)
+	cases := []struct {
+		value any
+		want  any
+	}{
+		{int64(42), int64(42)},
+		{"text", "text"},
+		{true, true},
+		// decimals and guids are converted in the select, bytes are binary even when they read as digits
+		{[]byte{0x31, 0x32}, "MTI="},
+		{[]byte{0xde, 0xad, 0xbe, 0xef}, "3q2+7w=="},
+		{time.Date(2023, 1, 2, 3, 4, 5, 600000000, offset), "2023-01-02T03:04:05.6+02:00"},
+	}
+	for _, c := range cases {
+		if got := variantValue(c.value); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("variantValue(%v) = %v, want %v", c.value, got, c.want)
+		}
+	}
+}
+
+// spatialBytes serializes a value the way SQL Server does: srid, version, properties, then the
+// points, figures and shapes.
+func spatialBytes(properties byte, points []float64, figures []int32, shapes [][3]int32) []byte {
+	var b bytes.Buffer
+	_ = binary.Write(&b, binary.LittleEndian, int32(4326))
+	b.Write([]byte{1, properties})
+	if properties&0x08 == 0 {
+		_ = binary.Write(&b, binary.LittleEndian, int32(len(points)/2))
+	}
+	_ = binary.Write(&b, binary.LittleEndian, points)
+	if properties&0x08 != 0 {
+		return b.Bytes()
+	}
+	_ = binary.Write(&b, binary.LittleEndian, int32(len(figures)))
+	for _, f := range figures {
+		b.WriteByte(1)
+		_ = binary.Write(&b, binary.LittleEndian, f)
+	}
+	_ = binary.Write(&b, binary.LittleEndian, int32(len(shapes)))
+	for _, s := range shapes {
+		_ = binary.Write(&b, binary.LittleEndian, s[0])
+		_ = binary.Write(&b, binary.LittleEndian, s[1])
+		b.WriteByte(byte(s[2]))
+	}
+	return b.Bytes()
+}
+
+func TestDecodeSpatial(t *testing.T) {
+	// geography stores latitude first
+	point, err := decodeSpatial(spatialBytes(0x0c, []float64{47.651, -122.349}, nil, nil), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wkt := point.WKT(); wkt != "POINT (-122.349 47.651)" {
+		t.Errorf("%s != POINT (-122.349 47.651)", wkt)
+	}
+	if geojson := point.GeoJSON(); !reflect.DeepEqual(geojson, map[string]any{"type": "Point", "coordinates": []float64{-122.349, 47.651}}) {
+		t.Errorf("unexpected GeoJSON %v", geojson)
+	}
+
+	polygon, err := decodeSpatial(spatialBytes(0x04, []float64{0, 0, 0, 10, 10, 10, 0, 0}, []int32{0}, [][3]int32{{-1, 0, 3}}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wkt := polygon.WKT(); wkt != "POLYGON ((0 0, 0 10, 10 10, 0 0))" {
+		t.Errorf("%s != POLYGON ((0 0, 0 10, 10 10, 0 0))", wkt)
+	}
+
+	multi, err := decodeSpatial(spatialBytes(0x04, []float64{1, 2, 3, 4}, []int32{0, 1}, [][3]int32{{-1, 0, 4}, {0, 0, 1}, {0, 1, 1}}), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wkt := multi.WKT(); wkt != "MULTIPOINT ((1 2), (3 4))" {
+		t.Errorf("%s != MULTIPOINT ((1 2), (3 4))", wkt)
+	}
+	if geojson := multi.GeoJSON(); !reflect.DeepEqual(geojson, map[string]any{"type": "MultiPoint", "coordinates": [][]float64{{1, 2}, {3, 4}}}) {
+		t.Errorf("unexpected GeoJSON %v", geojson)
+	}
+
+	if _, err := decodeSpatial([]byte{0xe6, 0x10, 0, 0, 1, 0x04, 0xff, 0xff}, false); err == nil {
+		t.Errorf("a truncated value should fail")
+	}
+
+	// a circular string, the arc through three points
+	arc := spatialBytes(0x04, []float64{0, 0, 1, 1, 2, 0}, []int32{0}, [][3]int32{{-1, 0, 8}})
+	arc[4] = 2
+	if _, err := decodeSpatial(arc, false); err == nil || !strings.Contains(err.Error(), "CircularString") {
+		t.Errorf("a circular string should fail as unsupported, got %v", err)
+	}
+	// a line string with a figure marked as an arc, the attribute follows the figure count
+	arc = spatialBytes(0x04, []float64{0, 0, 1, 1, 2, 0}, []int32{0}, [][3]int32{{-1, 0, 2}})
+	arc[4], arc[6+4+48+4] = 2, 2
+	if _, err := decodeSpatial(arc, false); err == nil || !strings.Contains(err.Error(), "circular arcs") {
+		t.Errorf("a figure of arcs should fail as unsupported, got %v", err)
+	}
+	// other shape types are unknown
+	if _, err := decodeSpatial(spatialBytes(0x04, []float64{0, 0}, []int32{0}, [][3]int32{{-1, 0, 42}}), false); err == nil || !strings.Contains(err.Error(), "type 42") {
+		t.Errorf("an unknown shape type should fail, got %v", err)
+	}
+}
+
+func TestSpatialText(t *testing.T) {
+	var geojson map[string]any
+	_ = json.Unmarshal([]byte(`{"type":"Polygon","coordinates":[[[10.7,59.9],[10.8,59.9],[10.8,60],[10.7,59.9]]]}`), &geojson)
+	wkt, err := spatialText(geojson)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wkt != "POLYGON ((10.7 59.9, 10.8 59.9, 10.8 60, 10.7 59.9))" {
+		t.Errorf("unexpected WKT %s", wkt)
+	}
+
+	if wkt, err := spatialText("POINT (10.7 59.9)"); err != nil || wkt != "POINT (10.7 59.9)" {
+		t.Errorf("WKT should be passed on, got %s, %v", wkt, err)
+	}
+	if _, err := spatialText("POINT (1 2)', 4326); DROP TABLE x; --"); err == nil {
+		t.Errorf("a value that is not WKT should fail")
+	}
+}
+
+func TestExpandJSON(t *testing.T) {
+	colMapping := &conf.ColumnMapping{
+		FieldName: "Document",
+		ParseJson: true,
+		JsonPaths: []*conf.JsonPathMapping{
+			{Path: "$.address.city"},
+			{Path: "$.lines[1].sku", PropertyName: "ns0:secondSku"},
+			{Path: "$.customer", PropertyName: "ns0:customer", IsReference: true, ReferenceTemplate: "http://data.test.io/customers/%v"},
+			{Path: "$.missing.value", PropertyName: "ns0:missing"},
+		},
+	}
+	entity := NewEntity()
+	text := `{"address":{"city":"Oslo"},"lines":[{"sku":"a"},{"sku":"b"}],"customer":12345678901234567890}`
+
+	if err := expandJSON(entity, "ns0:Document", text, colMapping); err != nil {
+		t.Fatal(err)
+	}
+	document, ok := entity.Properties["ns0:Document"].(map[string]any)
+	if !ok || document["address"].(map[string]any)["city"] != "Oslo" {
+		t.Errorf("the document should be parsed, got %v", entity.Properties["ns0:Document"])
+	}
+	if entity.Properties["ns0:city"] != "Oslo" {
+		t.Errorf("%v != Oslo", entity.Properties["ns0:city"])
+	}
+	if entity.Properties["ns0:secondSku"] != "b" {
+		t.Errorf("%v != b", entity.Properties["ns0:secondSku"])
+	}
+	if entity.References["ns0:customer"] != "http://data.test.io/customers/12345678901234567890" {
+		t.Errorf("large numbers should keep their digits, got %v", entity.References["ns0:customer"])
+	}
+	if _, ok := entity.Properties["ns0:missing"]; ok {
+		t.Errorf("a path that is not in the document should add nothing")
+	}
+
+	if err := expandJSON(NewEntity(), "ns0:Document", "not json", colMapping); err == nil {
+		t.Errorf("a column that is not JSON should fail")
+	}
+}
+
+func TestAddType(t *testing.T) {
+	entity := NewEntity()
+	addType(entity, "http://data.test.io/Asset")
+	if entity.References["rdf:type"] != "http://data.test.io/Asset" {
+		t.Errorf("a single type should be a string, got %v", entity.References["rdf:type"])
+	}
+
+	addType(entity, "http://data.test.io/Pump")
+	addType(entity, "http://data.test.io/Asset")
+	check := []string{"http://data.test.io/Asset", "http://data.test.io/Pump"}
+	if !reflect.DeepEqual(entity.References["rdf:type"], check) {
+		t.Errorf("%v != %v", entity.References["rdf:type"], check)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	refs := delimitedReferences("12; 44;;91", ";", "http://data.test.io/tags/%s")
+	check := []string{"http://data.test.io/tags/12", "http://data.test.io/tags/44", "http://data.test.io/tags/91"}
+	if !reflect.DeepEqual(refs, check) {
+		t.Errorf("%v != %v", refs, check)
+	}
+
+	child := &conf.ChildReference{TableName: "OrderLines", ReferenceTemplate: "http://data.test.io/orderlines/%v"}
+	refs, err := childReferences(`[{"v":1},{"v":12345678901234567890},{"v":"a/b"}]`, child)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check = []string{"http://data.test.io/orderlines/1", "http://data.test.io/orderlines/12345678901234567890", "http://data.test.io/orderlines/a/b"}
+	if !reflect.DeepEqual(refs, check) {
+		t.Errorf("%v != %v", refs, check)
+	}
+}
+
+func TestEmbedder(t *testing.T) {
+	tableDef := &conf.TableMapping{
+		TableName:      "Customers",
+		ColumnMappings: []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}},
+		EmbeddedEntities: []*conf.EmbeddedEntity{
+			{TableName: "Addresses", ForeignKey: "CustomerId"},
+			{TableName: "Contacts", ForeignKey: "CustomerCode", ParentColumn: "Code"},
+		},
+	}
+	if column := parentColumn(tableDef, tableDef.EmbeddedEntities[0]); column != "Id" {
+		t.Errorf("the parent column should default to the id column, got %s", column)
+	}
+
+	var emitted []string
+	l := &Layer{}
+	e := l.newEmbedder(tableDef, []string{"Id", "Code"}, nil, func(entity *Entity) {
+		emitted = append(emitted, entity.ID)
+	})
+	if !reflect.DeepEqual(e.indexes, []int{0, 1}) {
+		t.Errorf("%v != [0 1]", e.indexes)
+	}
+
+	// deleted entities have nothing embedded, and are held back to keep the order of the read
+	for _, id := range []string{"a", "b"} {
+		entity := NewEntity()
+		entity.ID = id
+		entity.IsDeleted = true
+		if err := e.add(entity, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(emitted) != 0 {
+		t.Errorf("entities should be held back until the batch is flushed, got %v", emitted)
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(emitted, []string{"a", "b"}) {
+		t.Errorf("%v != [a b]", emitted)
+	}
+}
+
+func TestForeignKeyReferences(t *testing.T) {
+	datalayer := &conf.Datalayer{
+		Schema: "dbo",
+		TableMappings: []*conf.TableMapping{
+			{
+				TableName:           "Customers",
+				EntityIdConstructor: "customer/%s",
+				ColumnMappings:      []*conf.ColumnMapping{{FieldName: "Id", IsIdColumn: true}},
+			},
+			{
+				TableName:           "OrderLines",
+				EntityIdConstructor: "orderlines/{OrderId}/{LineNo}",
+			},
+		},
+	}
+	fks := []*db.ForeignKey{
+		{Name: "FK_Customer", Columns: []string{"CustomerId"}, ReferencedSchema: "dbo", ReferencedTable: "customers", ReferencedColumns: []string{"ID"}},
+		{Name: "FK_Line", Columns: []string{"LineNo", "OrderId"}, ReferencedSchema: "dbo", ReferencedTable: "OrderLines", ReferencedColumns: []string{"LineNo", "OrderId"}},
+		{Name: "FK_Code", Columns: []string{"CustomerCode"}, ReferencedSchema: "dbo", ReferencedTable: "Customers", ReferencedColumns: []string{"Code"}},
+		{Name: "FK_Other", Columns: []string{"RegionId"}, ReferencedSchema: "dbo", ReferencedTable: "Regions", ReferencedColumns: []string{"Id"}},
+	}
+
+	refs := resolveForeignKeys(datalayer, fks)
+	if len(refs) != 2 {
+		t.Fatalf("only keys pointing at the id columns of mapped tables should be kept, got %d", len(refs))
+	}
+
+	keys := map[string]string{"CustomerId": "42", "OrderId": "7", "LineNo": "3"}
+	if id, ok := refs[0].reference("http://data.test.io/", keys); !ok || id != "http://data.test.io/customer/42" {
+		t.Errorf("unexpected reference %s", id)
+	}
+	if id, ok := refs[1].reference("http://data.test.io/", keys); !ok || id != "http://data.test.io/orderlines/7/3" {
+		t.Errorf("unexpected reference %s", id)
+	}
+	if _, ok := refs[0].reference("http://data.test.io/", map[string]string{}); ok {
+		t.Error("a null foreign key should not be a reference")
+	}
+}
+
+func TestGenerateConfig(t *testing.T) {
+	columns := []*db.CatalogColumn{
+		{Schema: "dbo", Table: "Customers", Name: "Id", Type: "int", PrimaryKey: true, Identity: true, CDCEnabled: true},
+		{Schema: "dbo", Table: "Customers", Name: "Name", Type: "nvarchar", MaxLength: 200, CDCEnabled: true},
+		{Schema: "sales", Table: "Orders", Name: "OrderId", Type: "int", PrimaryKey: true},
+		{Schema: "sales", Table: "Orders", Name: "CustomerId", Type: "int"},
+		{Schema: "sales", Table: "Orders", Name: "CustomerName", Type: "nvarchar", MaxLength: 200},
+		{Schema: "sales", Table: "Orders", Name: "Total", Type: "decimal", Precision: 10, Scale: 2},
+		{Schema: "sales", Table: "Orders", Name: "Version", Type: "timestamp"},
+		{Schema: "sales", Table: "OrderLines", Name: "OrderId", Type: "int", PrimaryKey: true},
+		{Schema: "sales", Table: "OrderLines", Name: "LineNo", Type: "int", PrimaryKey: true},
+	}
+	fks := map[string][]*db.ForeignKey{
+		"sales.Orders": {
+			{Name: "FK_Customer", Columns: []string{"CustomerId"}, ReferencedSchema: "dbo", ReferencedTable: "Customers", ReferencedColumns: []string{"Id"}},
+			{Name: "FK_CustomerName", Columns: []string{"CustomerName"}, ReferencedSchema: "dbo", ReferencedTable: "Customers", ReferencedColumns: []string{"Name"}},
+		},
+	}
+	config := generateConfig(&conf.Datalayer{BaseUri: "http://data.test.io/", Password: "secret"}, columns, fks)
+
+	if config.Password != "" || len(config.TableMappings) != 3 || len(config.PostMappings) != 3 {
+		t.Fatalf("unexpected config %+v", config)
+	}
+	customers, orders, lines := config.TableMappings[0], config.TableMappings[1], config.TableMappings[2]
+	if !customers.CDCEnabled || customers.EntityIdConstructor != "customers/%s" || !customers.ColumnMappings[0].IsIdColumn {
+		t.Errorf("unexpected customers mapping %+v", customers)
+	}
+	if orders.RowVersionColumn != "Version" || *orders.Config.Schema != "sales" {
+		t.Errorf("unexpected orders mapping %+v", orders)
+	}
+	if cm := orders.ColumnMappings[1]; !cm.IsReference || cm.ReferenceTemplate != "http://data.test.io/customers/%s" {
+		t.Errorf("the foreign key should be a reference, got %+v", cm)
+	}
+	if cm := orders.ColumnMappings[2]; cm.IsReference || orders.ForeignKeyReferences {
+		t.Errorf("a foreign key to a column that is not the primary key should not be a reference, got %+v", cm)
+	}
+	if lines.EntityIdConstructor != "orderlines/{OrderId}/{LineNo}" || config.PostMappings[2].EntityIdConstructor != lines.EntityIdConstructor {
+		t.Errorf("unexpected order lines mapping %+v", lines)
+	}
+
+	// identity and rowversion columns are filled in by the database
+	if post := config.PostMappings[0]; post.IdColumn != "" || len(post.FieldMappings) != 1 || post.FieldMappings[0].DataType != "NVARCHAR(100)" {
+		t.Errorf("unexpected customers post mapping %+v", post)
+	}
+	var types []string
+	for _, fm := range config.PostMappings[1].FieldMappings {
+		types = append(types, fm.DataType)
+	}
+	if !reflect.DeepEqual(types, []string{"INT", "INT", "NVARCHAR(100)", "DECIMAL(10,2)"}) {
+		t.Errorf("unexpected data types %v", types)
+	}
+}
+
+func TestGenerateConfig_SchemaQualifiesDatasets(t *testing.T) {
+	columns := []*db.CatalogColumn{
+		{Schema: "dbo", Table: "Orders", Name: "Id", Type: "int", PrimaryKey: true},
+		{Schema: "sales", Table: "Orders", Name: "Id", Type: "int", PrimaryKey: true},
+		{Schema: "archive", Table: "Orders", Name: "Id", Type: "int", PrimaryKey: true},
+	}
+	config := generateConfig(&conf.Datalayer{BaseUri: "http://data.test.io/"}, columns, nil)
+
+	var tables, posts []string
+	for i := range config.TableMappings {
+		tables = append(tables, config.TableMappings[i].DatasetName)
+		posts = append(posts, config.PostMappings[i].DatasetName)
+	}
+	if !reflect.DeepEqual(tables, []string{"", "sales.Orders", "archive.Orders"}) {
+		t.Errorf("unexpected table mapping dataset names %v", tables)
+	}
+	if !reflect.DeepEqual(posts, []string{"Orders", "sales.Orders", "archive.Orders"}) {
+		t.Errorf("unexpected post mapping dataset names %v", posts)
+	}
+	if err := config.Validate(); err != nil {
+		t.Errorf("the generated configuration should be valid, got %v", err)
+	}
+}
+
+func TestDescribeColumns(t *testing.T) {
+	tableDef := &conf.TableMapping{
+		TableName:           "Orders",
+		CDCEnabled:          true,
+		EntityIdConstructor: "order/%s",
+		ChildReferences:     []*conf.ChildReference{{TableName: "OrderLines"}},
+		Columns: map[string]*conf.ColumnMapping{
+			"Id":       {FieldName: "Id", IsIdColumn: true},
+			"Customer": {FieldName: "Customer", IsReference: true, PropertyName: "ns0:customer"},
+			"Secret":   {FieldName: "Secret", IgnoreColumn: true},
+		},
+	}
+	columns := describeColumns(tableDef, []*ColumnSchema{
+		{Name: "__$operation"}, {Name: "Id"}, {Name: "Customer"}, {Name: "Secret"}, {Name: "Region"}, {Name: "__$children_0"},
+	}, []*foreignKeyReference{{columns: []string{"Region"}}})
+
+	check := []ColumnSchema{
+		{Name: "__$operation", Ignored: true},
+		{Name: "Id", Property: "ns0:Id", IsId: true},
+		{Name: "Customer", Property: "ns0:customer", IsReference: true},
+		{Name: "Secret", Ignored: true},
+		{Name: "Region", Property: "ns0:Region", IsReference: true},
+		{Name: "__$children_0", Property: "ns0:OrderLines", IsReference: true},
+	}
+	for i, c := range columns {
+		if *c != check[i] {
+			t.Errorf("%+v != %+v", *c, check[i])
+		}
+	}
+
+	if strategy := incrementalStrategy(tableDef); strategy != "cdc" {
+		t.Errorf("unexpected strategy %s", strategy)
+	}
+	schema := "sales"
+	config := withoutSecrets(&conf.TableConfig{Schema: &schema, Password: &conf.VariableGetter{Key: "DB_PASSWORD"}})
+	if config.Password != nil || *config.Schema != "sales" {
+		t.Errorf("unexpected config %+v", config)
+	}
+}
+
+func TestSoftDeleted(t *testing.T) {
+	deletedAt := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	bigint := sql.RawBytes("2")
+	tests := []struct {
+		name   string
+		raw    interface{}
+		ctName string
+		value  string
+		check  bool
+	}{
+		{"a set deleted_at", &sql.NullTime{Time: deletedAt, Valid: true}, "DATETIME2", "", true},
+		{"a null deleted_at", &sql.NullTime{}, "DATETIME2", "", false},
+		{"a set is_deleted bit", &sql.NullBool{Bool: true, Valid: true}, "BIT", "", true},
+		{"a cleared is_deleted bit", &sql.NullBool{Valid: true}, "BIT", "", false},
+		{"a bit compared to 1", &sql.NullBool{Bool: true, Valid: true}, "BIT", "1", true},
+		{"a status", &sql.NullString{String: "DELETED", Valid: true}, "VARCHAR", "DELETED", true},
+		{"another status", &sql.NullString{String: "ACTIVE", Valid: true}, "VARCHAR", "DELETED", false},
+		{"an int", &sql.NullInt64{Int64: 9, Valid: true}, "INT", "9", true},
+		{"a bigint", &bigint, "BIGINT", "1", false},
+		{"a time", &sql.NullTime{Time: deletedAt, Valid: true}, "DATETIME2", "2024-05-06T07:08:09Z", true},
+		{"a zero int", &sql.NullInt64{Valid: true}, "INT", "", false},
+		{"a set int", &sql.NullInt64{Int64: 1, Valid: true}, "TINYINT", "", true},
+		{"a zero float", &sql.NullFloat64{Valid: true}, "FLOAT", "", false},
+	}
+	for _, test := range tests {
+		if deleted := softDeleted(test.raw, test.ctName, test.value); deleted != test.check {
+			t.Errorf("%s with %q: %v != %v", test.name, test.value, deleted, test.check)
+		}
+	}
+}
+
+// fakeConnector is a database that answers each query with the rows of the first result whose
+// match is part of it, and remembers the queries and arguments it was sent.
+type fakeConnector struct {
+	results []fakeResult
+	queries []string
+	args    [][]any
+}
+
+type fakeResult struct {
+	match   string
+	arg     any // the first argument of the query, when set
+	columns []string
+	types   []string
+	rows    [][]driver.Value
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) { return fakeConn{c}, nil }
+func (c *fakeConnector) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeConnector }
+
+func (c fakeConn) Prepare(string) (driver.Stmt, error) { return nil, driver.ErrSkip }
+func (c fakeConn) Close() error                        { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)           { return nil, driver.ErrSkip }
+
+// CheckNamedValue takes the arguments as they are, like the mssql driver takes its own types.
+func (c fakeConn) CheckNamedValue(*driver.NamedValue) error { return nil }
+
+func (c fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	values := make([]any, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	c.db.queries = append(c.db.queries, query)
+	c.db.args = append(c.db.args, values)
+	for _, result := range c.db.results {
+		if strings.Contains(query, result.match) && (result.arg == nil || len(values) > 0 && reflect.DeepEqual(values[0], result.arg)) {
+			return &fakeRows{result: result}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected query %s", query)
+}
+
+type fakeRows struct {
+	result fakeResult
+	next   int
+}
+
+func (r *fakeRows) Columns() []string { return r.result.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) ColumnTypeDatabaseTypeName(i int) string {
+	return r.result.types[i]
+}
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.result.rows) {
+		return io.EOF
+	}
+	copy(dest, r.result.rows[r.next])
+	r.next++
+	return nil
+}
+
+func fakeLayer(fake *fakeConnector, tables ...*conf.TableMapping) *Layer {
+	for _, table := range tables {
+		table.Columns = map[string]*conf.ColumnMapping{}
+		for _, cm := range table.ColumnMappings {
+			table.Columns[cm.FieldName] = cm
+		}
+	}
+	return &Layer{
+		cmgr: &conf.ConfigurationManager{
+			Datalayer: &conf.Datalayer{
+				BaseUri:       "http://data.test.io/",
+				Schema:        "dbo",
+				TableMappings: tables,
+			},
+		},
+		logger: zap.NewNop().Sugar(),
+		Repo:   &Repository{DB: sql.OpenDB(fake), ctx: context.Background()},
+		statsd: &statsd.NoOpClient{},
+		env:    &conf.Env{},
+	}
+}
+
+func readChangeSet(t *testing.T, layer *Layer, request db.DatasetRequest) ([]string, string) {
+	t.Helper()
+	var ids []string
+	token := ""
+	err := layer.ChangeSet(request, func(entity *Entity) {
+		if entity.ID == "@continuation" {
+			token = entity.Properties["token"].(string)
+		} else {
+			ids = append(ids, entity.ID)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids, token
+}
+
+func TestChangeSet_PagesEntitiesByCompositeKey(t *testing.T) {
+	lines := &conf.TableMapping{
+		TableName:           "OrderLines",
+		EntityIdConstructor: "orderlines/{OrderId}/{LineNo}",
+		ChangeTracking:      true,
+		ColumnMappings: []*conf.ColumnMapping{
+			{FieldName: "OrderId", IsIdColumn: true},
+			{FieldName: "LineNo", IsIdColumn: true},
+		},
+	}
+	fake := &fakeConnector{}
+	layer := fakeLayer(fake, lines)
+	page := func(version int64, rows ...[]driver.Value) {
+		fake.results = []fakeResult{
+			{match: "CHANGE_TRACKING_CURRENT_VERSION", columns: []string{""}, types: []string{"BIGINT"}, rows: [][]driver.Value{{version}}},
+			{match: "FROM [dbo].[OrderLines]", columns: []string{"OrderId", "LineNo", "Product"}, types: []string{"INT", "SMALLINT", "NVARCHAR"}, rows: rows},
+		}
+	}
+
+	// a full page ends with a cursor on the key of its last row
+	page(42, []driver.Value{int64(1), int64(1), "apples"}, []driver.Value{int64(1), int64(2), "pears"})
+	ids, token := readChangeSet(t, layer, db.DatasetRequest{DatasetName: "OrderLines", Entities: true, Limit: 2})
+	if !reflect.DeepEqual(ids, []string{"http://data.test.io/orderlines/1/1", "http://data.test.io/orderlines/1/2"}) {
+		t.Errorf("unexpected first page %v", ids)
+	}
+	cursor, err := db.DecodeCursor(token)
+	if err != nil {
+		t.Fatalf("the first page should end with a cursor, got %q: %v", token, err)
+	}
+	if args, _ := cursor.Args(); !reflect.DeepEqual(args, []any{int64(1), int64(2)}) {
+		t.Errorf("the cursor should hold the last key, got %v", args)
+	}
+	if cursor.Since != db.EncodeVersion(42) {
+		t.Errorf("the cursor should carry the change token taken before the first page, got %q", cursor.Since)
+	}
+
+	// the next page starts after that key, and a short page is the last one. it hands off the
+	// change token of the first page, not a newer one
+	page(50, []driver.Value{int64(2), int64(1), "plums"})
+	ids, token = readChangeSet(t, layer, db.DatasetRequest{DatasetName: "OrderLines", Entities: true, Limit: 2, From: token})
+	if !reflect.DeepEqual(ids, []string{"http://data.test.io/orderlines/2/1"}) {
+		t.Errorf("unexpected last page %v", ids)
+	}
+	query := fake.queries[len(fake.queries)-1]
+	if !strings.Contains(query, "WHERE ([OrderId] > @p2 OR ([OrderId] = @p2 AND [LineNo] > @p3)) ORDER BY [OrderId], [LineNo]") {
+		t.Errorf("the next page should seek past the key, got %s", query)
+	}
+	if args := fake.args[len(fake.args)-1]; !reflect.DeepEqual(args, []any{int64(2), int64(1), int64(2)}) {
+		t.Errorf("unexpected arguments %v", args)
+	}
+	if token != db.EncodeVersion(42) {
+		t.Errorf("the last page should hand off the change token of the first, got %q", token)
+	}
+}
+
+func TestChangeSet_ReadsUnpageableEntitiesInFull(t *testing.T) {
+	orders := &conf.TableMapping{
+		TableName:           "Orders",
+		CustomQuery:         "SELECT %s* FROM OrderView",
+		EntityIdConstructor: "orders/%s",
+		ColumnMappings: []*conf.ColumnMapping{
+			{FieldName: "Id", IsIdColumn: true},
+		},
+	}
+	fake := &fakeConnector{results: []fakeResult{
+		{match: "GETDATE", columns: []string{""}, types: []string{"DATETIME"}, rows: [][]driver.Value{{time.Now()}}},
+		{match: "FROM OrderView", columns: []string{"Id"}, types: []string{"INT"}, rows: [][]driver.Value{{int64(1)}, {int64(2)}, {int64(3)}}},
+	}}
+	layer := fakeLayer(fake, orders)
+
+	// a custom query can not be seeked into, so the limit is left out rather than losing the rows after it
+	ids, token := readChangeSet(t, layer, db.DatasetRequest{DatasetName: "Orders", Entities: true, Limit: 2})
+	if len(ids) != 3 || token != "" {
+		t.Errorf("all rows should be read without a token, got %v and %q", ids, token)
+	}
+	if query := fake.queries[len(fake.queries)-1]; query != "SELECT * FROM OrderView" {
+		t.Errorf("unexpected query %s", query)
+	}
+}
+
+func TestChangeSet_HandsOffTheHighestSinceValue(t *testing.T) {
+	customers := &conf.TableMapping{
+		TableName:           "Customers",
+		EntityIdConstructor: "customers/%s",
+		SinceColumn:         "Updated",
+		ColumnMappings: []*conf.ColumnMapping{
+			{FieldName: "Id", IsIdColumn: true},
+		},
+	}
+	highest := time.Date(2024, 5, 6, 7, 8, 9, 123456700, time.UTC)
+	fake := &fakeConnector{results: []fakeResult{
+		{match: "SELECT MAX([Updated]) FROM [dbo].[Customers]", columns: []string{""}, types: []string{"DATETIME2"}, rows: [][]driver.Value{{highest}}},
+		{match: "FROM [dbo].[Customers]", columns: []string{"Id", "Updated"}, types: []string{"INT", "DATETIME2"}, rows: [][]driver.Value{{int64(1), highest}}},
+	}}
+	layer := fakeLayer(fake, customers)
+
+	ids, token := readChangeSet(t, layer, db.DatasetRequest{DatasetName: "Customers", Entities: true, Limit: 10})
+	if len(ids) != 1 {
+		t.Errorf("unexpected entities %v", ids)
+	}
+	if !strings.HasPrefix(fake.queries[0], "SELECT MAX(") {
+		t.Errorf("the token should be taken before the first page, got %s first", fake.queries[0])
+	}
+	if token != db.EncodeSince(highest) {
+		t.Errorf("%q != %q", token, db.EncodeSince(highest))
+	}
+}
+
+func TestChangeSet_RejectsATokenOlderThanEmbeddedChanges(t *testing.T) {
+	customers := &conf.TableMapping{
+		TableName:           "Customers",
+		EntityIdConstructor: "customers/%s",
+		CDCEnabled:          true,
+		ColumnMappings: []*conf.ColumnMapping{
+			{FieldName: "Id", IsIdColumn: true},
+		},
+		EmbeddedEntities: []*conf.EmbeddedEntity{
+			{TableName: "Addresses", ForeignKey: "CustomerId", CDCEnabled: true},
+		},
+	}
+	since := db.CDCToken{Lsn: []byte{0, 0, 0, 0x2a, 0, 0, 0, 0x10, 0, 0x01}}
+	fake := &fakeConnector{results: []fakeResult{
+		{match: "fn_cdc_get_max_lsn", columns: []string{""}, types: []string{"BINARY"}, rows: [][]driver.Value{{[]byte{0, 0, 0, 0x2b, 0, 0, 0, 0x20, 0, 0x01}}}},
+		{match: "SELECT sys.fn_cdc_get_min_lsn(@p1)", arg: "dbo_Customers", columns: []string{""}, types: []string{"BINARY"}, rows: [][]driver.Value{{[]byte{0, 0, 0, 0x20, 0, 0, 0, 0, 0, 0}}}},
+		// the cleanup job has removed the addresses changes after the token
+		{match: "SELECT sys.fn_cdc_get_min_lsn(@p1)", arg: "dbo_Addresses", columns: []string{""}, types: []string{"BINARY"}, rows: [][]driver.Value{{[]byte{0, 0, 0, 0x2b, 0, 0, 0, 0, 0, 0}}}},
+		{match: "fn_cdc_get_all_changes_dbo_Customers", columns: []string{"Id", "__$operation"}, types: []string{"INT", "INT"}},
+	}}
+	layer := fakeLayer(fake, customers)
+
+	err := layer.ChangeSet(db.DatasetRequest{DatasetName: "Customers", Since: since.Encode()}, func(*Entity) {})
+	if !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("a token older than the embedded changes should be expired, got %v", err)
+	}
+	for _, query := range fake.queries {
+		if strings.Contains(query, "fn_cdc_get_all_changes_dbo_Addresses") {
+			t.Errorf("the embedded changes should not be read, got %s", query)
+		}
+	}
+}
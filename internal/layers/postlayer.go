@@ -15,6 +15,7 @@ import (
 	mssql "github.com/microsoft/go-mssqldb"
 	"github.com/mimiro-io/internal-go-util/pkg/uda"
 	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
 	"github.com/spf13/cast"
 	"go.uber.org/fx"
 	"go.uber.org/zap"
@@ -161,7 +162,9 @@ func (postLayer *PostLayer) CustomQuery(entities []*Entity, query string, fields
 
 func (postLayer *PostLayer) CustomDelete(post *Entity, fields []*conf.FieldMapping, s map[string]interface{}, rowId string, timeZone string, queryDel string) (string, error) {
 	delQueue := ""
-	if postLayer.PostRepo.PostTableDef.IdColumn == "" {
+	if conf.KeyColumns(postLayer.PostRepo.PostTableDef.EntityIdConstructor) != nil {
+		return postLayer.keyDelete(post, postLayer.PostRepo.PostTableDef.TableName)
+	} else if postLayer.PostRepo.PostTableDef.IdColumn == "" {
 		postLayer.logger.Warn(fmt.Sprintf("Cannot delete entitywhere Id-column is not specified:\t %s", post.ID))
 	} else {
 		location, err := loadLocation(timeZone)
@@ -189,8 +192,12 @@ func (postLayer *PostLayer) CustomDelete(post *Entity, fields []*conf.FieldMappi
 					rowId += strconv.FormatBool(bit)
 				case "INT", "SMALLINT", "TINYINT", "INTEGER":
 					rowId += strconv.FormatInt(cast.ToInt64(value.(float64)), 10)
-				case "FLOAT", "DECIMAL", "NUMERIC":
-					rowId += fmt.Sprintf("%f", value)
+				case "FLOAT", "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+					d, err := decimalValue(value)
+					if err != nil {
+						return "", parseError(field.FieldName, datatype, value, post.ID, err)
+					}
+					rowId += d
 				case "DATETIME", "DATETIME2":
 					t, err := time.Parse(time.RFC3339, fmt.Sprintf("%s", value))
 					if err != nil {
@@ -286,8 +293,12 @@ func (postLayer *PostLayer) CreatePayload(post *Entity, fields []*conf.FieldMapp
 				columnValues = append(columnValues, bit)
 			case "INT", "SMALLINT", "TINYINT", "INTEGER":
 				columnValues = append(columnValues, int64(value.(float64)))
-			case "FLOAT", "DECIMAL", "NUMERIC":
-				columnValues = append(columnValues, fmt.Sprintf("%f", value))
+			case "FLOAT", "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+				d, err := decimalValue(value)
+				if err != nil {
+					return nil, parseError(field.FieldName, datatype, value, post.ID, err)
+				}
+				columnValues = append(columnValues, d)
 			case "DATETIME", "DATETIME2":
 				t, err := time.Parse(time.RFC3339, fmt.Sprintf("%s", value))
 				if err != nil {
@@ -306,8 +317,19 @@ func (postLayer *PostLayer) CreatePayload(post *Entity, fields []*conf.FieldMapp
 					return nil, parseError(field.FieldName, datatype, value, post.ID, err)
 				}
 				columnValues = append(columnValues, mssql.DateTimeOffset(t))
-			default: // all other types can be sent as string
-				columnValues = append(columnValues, fmt.Sprintf("%s", value))
+			case "GEOGRAPHY", "GEOMETRY":
+				// the query turns the text into the spatial type, with STGeomFromText
+				wkt, err := spatialText(value)
+				if err != nil {
+					return nil, parseError(field.FieldName, datatype, value, post.ID, err)
+				}
+				columnValues = append(columnValues, wkt)
+			default: // all other types can be sent as string, nested properties as JSON
+				text, err := jsonText(value)
+				if err != nil {
+					return nil, parseError(field.FieldName, datatype, value, post.ID, err)
+				}
+				columnValues = append(columnValues, text)
 			}
 		}
 	}
@@ -368,17 +390,35 @@ func (postLayer *PostLayer) CreateUpsertBulk(entities []*Entity, fields []*conf.
 		return "", err
 	}
 	buildQuery := ""
+	compositeKey := conf.KeyColumns(postLayer.PostRepo.PostTableDef.EntityIdConstructor) != nil
 	for _, post := range entities {
 		if !strings.ContainsAny(post.ID, ":") {
 			continue
 		}
+		if compositeKey {
+			// the row is found by the key columns in the entity id, also when the entity has no properties
+			del, err := postLayer.keyDelete(post, tableName)
+			if err != nil {
+				return "", err
+			}
+			buildQuery += del
+			if post.IsDeleted {
+				continue
+			}
+		}
 		s := post.StripProps()
 		args := make([]interface{}, len(fields))
 		columnValues := ""
 		rowId := ""
 		InsertColumnNamesValues := ""
 		if !post.IsDeleted { //If is deleted True just create the delete statement
-			buildQuery += postLayer.createDelete(s, idColumn, fields, tableName)
+			if !compositeKey {
+				del, err := postLayer.createDelete(s, idColumn, fields, tableName, post.ID)
+				if err != nil {
+					return "", err
+				}
+				buildQuery += del
+			}
 			buildQuery += fmt.Sprintf("INSERT INTO %s (", strings.ToLower(tableName))
 			for i, field := range fields {
 				var value interface{}
@@ -406,8 +446,12 @@ func (postLayer *PostLayer) CreateUpsertBulk(entities []*Entity, fields []*conf.
 						columnValues += bit + ","
 					case "INT", "SMALLINT", "TINYINT", "INTEGER":
 						columnValues += strconv.FormatInt(cast.ToInt64(value.(float64)), 10) + ","
-					case "FLOAT", "DECIMAL", "NUMERIC":
-						columnValues += fmt.Sprintf("%f", value) + ","
+					case "FLOAT", "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+						d, err := decimalValue(value)
+						if err != nil {
+							return "", parseError(field.FieldName, datatype, value, post.ID, err)
+						}
+						columnValues += d + ","
 					case "DATETIME", "DATETIME2":
 						t, err := time.Parse(time.RFC3339, fmt.Sprintf("%s", value))
 						if err != nil {
@@ -422,8 +466,24 @@ func (postLayer *PostLayer) CreateUpsertBulk(entities []*Entity, fields []*conf.
 						}
 					case "DATETIMEOFFSET":
 						columnValues += "'" + fmt.Sprintf("%s", value) + "',"
+					case "GEOGRAPHY", "GEOMETRY":
+						wkt, err := spatialText(value)
+						if err != nil {
+							return "", parseError(field.FieldName, datatype, value, post.ID, err)
+						}
+						columnValues += fmt.Sprintf("%s::STGeomFromText(N'%s', %d),", strings.ToLower(datatype), wkt, srid(field))
 					default: // all other types can be sent as string
-						columnValues += fmt.Sprintf("'%s',", value)
+						switch value.(type) {
+						case map[string]interface{}, []interface{}:
+							// nested properties go back into a JSON column
+							text, err := jsonText(value)
+							if err != nil {
+								return "", parseError(field.FieldName, datatype, value, post.ID, err)
+							}
+							columnValues += "N'" + strings.ReplaceAll(text, "'", "''") + "',"
+						default:
+							columnValues += fmt.Sprintf("'%s',", value)
+						}
 					}
 				}
 				if field.FieldName == idColumn {
@@ -457,8 +517,12 @@ func (postLayer *PostLayer) CreateUpsertBulk(entities []*Entity, fields []*conf.
 						rowId += bit
 					case "INT", "BIGINT", "SMALLINT", "TINYINT", "INTEGER":
 						rowId += strconv.FormatInt(cast.ToInt64(value.(float64)), 10)
-					case "FLOAT", "DECIMAL", "NUMERIC":
-						rowId += fmt.Sprintf("%f", value)
+					case "FLOAT", "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+						d, err := decimalValue(value)
+						if err != nil {
+							return "", parseError(field.FieldName, datatype, value, post.ID, err)
+						}
+						rowId += d
 					case "DATETIME", "DATETIME2":
 						t, err := time.Parse(time.RFC3339, fmt.Sprintf("%s", value))
 						if err != nil {
@@ -482,14 +546,17 @@ func (postLayer *PostLayer) GetTableDefinition(datasetName string) *conf.PostMap
 	for _, table := range postLayer.Cmgr.Datalayer.PostMappings {
 		if table.DatasetName == datasetName {
 			return table
-		} else if table.TableName == datasetName { // fallback
+		}
+	}
+	for _, table := range postLayer.Cmgr.Datalayer.PostMappings {
+		if table.TableName == datasetName { // fallback
 			return table
 		}
 	}
 	return nil
 }
 
-func (postLayer *PostLayer) createDelete(s map[string]interface{}, idColumn string, fields []*conf.FieldMapping, tableName string) string {
+func (postLayer *PostLayer) createDelete(s map[string]interface{}, idColumn string, fields []*conf.FieldMapping, tableName string, entityID string) (string, error) {
 	var value interface{}
 	for _, field := range fields {
 		if field.FieldName == idColumn {
@@ -517,8 +584,12 @@ func (postLayer *PostLayer) createDelete(s map[string]interface{}, idColumn stri
 					value = bit
 				case "INT", "SMALLINT", "TINYINT", "INTEGER":
 					value = strconv.FormatInt(cast.ToInt64(value.(float64)), 10)
-				case "FLOAT", "DECIMAL", "NUMERIC":
-					value = fmt.Sprintf("%f", value)
+				case "FLOAT", "DECIMAL", "NUMERIC", "MONEY", "SMALLMONEY":
+					d, err := decimalValue(value)
+					if err != nil {
+						return "", parseError(field.FieldName, datatype, value, entityID, err)
+					}
+					value = d
 				default: // all other types can be sent as string
 					value = fmt.Sprintf("'%s'", value)
 				}
@@ -528,7 +599,52 @@ func (postLayer *PostLayer) createDelete(s map[string]interface{}, idColumn stri
 	}
 
 	deleteStmt := fmt.Sprintf("DELETE FROM %s WHERE %s = %s"+";", tableName, idColumn, value)
-	return deleteStmt
+	return deleteStmt, nil
+}
+
+// srid is the spatial reference of a posted geography or geometry field, WGS 84 for a geography
+// unless another one is configured.
+func srid(field *conf.FieldMapping) int {
+	if field.Srid == 0 && strings.HasPrefix(field.DataType, "GEOGRAPHY") {
+		return 4326
+	}
+	return field.Srid
+}
+
+// decimalValue returns a FLOAT, DECIMAL, NUMERIC or MONEY value as the text of the number. An
+// exact decimal is posted as a string and passed on as it is, a JSON number is written with the
+// fewest digits that read back as the same float64.
+func decimalValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		if !decimalPattern.MatchString(v) {
+			return "", fmt.Errorf("%q is not a decimal", v)
+		}
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("%v is not a number", value)
+	}
+}
+
+// keyDelete creates the delete statement for the row an entity id points at, from the values of
+// the key columns named in the entityIdConstructor of the post mapping.
+func (postLayer *PostLayer) keyDelete(post *Entity, tableName string) (string, error) {
+	constructor := postLayer.PostRepo.PostTableDef.EntityIdConstructor
+	values, err := DecomposeEntityId(constructor, post.ID)
+	if err != nil {
+		return "", err
+	}
+	where := ""
+	for _, column := range conf.KeyColumns(constructor) {
+		if where != "" {
+			where += " AND "
+		}
+		// the values are strings from the id, the server converts them to the column type
+		where += fmt.Sprintf("%s = N'%s'", db.QuoteName(column), strings.ReplaceAll(values[column], "'", "''"))
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s;", tableName, where), nil
 }
 
 func (postLayer *PostLayer) setVars() (string, string, string, string, []*conf.FieldMapping) {
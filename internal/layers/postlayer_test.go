@@ -85,7 +85,7 @@ func TestUpsertBulk(t *testing.T) {
 			pl.PostRepo.PostTableDef = datalayer.PostMappings[0]
 			query, err := (*layers.PostLayer).CreateUpsertBulk(pl, entities, pl.PostRepo.PostTableDef.FieldMappings, "DELETE FROM test WHERE Id = ", "Id", "Europe/Oslo", "test")
 			g.Assert(err).IsNil()
-			g.Assert(query).Eql("DELETE FROM test WHERE Id = 'a:1';DELETE FROM test WHERE Id = 'a:2';DELETE FROM test WHERE Id = 'a:3';INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Datetime, Column_Datetime2, Column_DatetimeOffset, Column_Varchar, Column_Decimal, Column_Numeric, Column_Date ) VALUES ( 'a:3',12344556,13,41,0,7.990000,'2023-01-01T01:01:01','2023-01-01T00:01:01','2023-01-01T01:01:01+02:00','b:string',90.090000,211.110000,'2023-01-01' );DELETE FROM test WHERE Id = 'a:4';INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Varchar, Column_Decimal, Column_Numeric ) VALUES ( 'a:4',12344556,13,41,0,7.990000,'b:string',90.090000,211.110000 );")
+			g.Assert(query).Eql("DELETE FROM test WHERE Id = 'a:1';DELETE FROM test WHERE Id = 'a:2';DELETE FROM test WHERE Id = 'a:3';INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Datetime, Column_Datetime2, Column_DatetimeOffset, Column_Varchar, Column_Decimal, Column_Numeric, Column_Date ) VALUES ( 'a:3',12344556,13,41,0,7.99,'2023-01-01T01:01:01','2023-01-01T00:01:01','2023-01-01T01:01:01+02:00','b:string',90.09,211.11,'2023-01-01' );DELETE FROM test WHERE Id = 'a:4';INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Varchar, Column_Decimal, Column_Numeric ) VALUES ( 'a:4',12344556,13,41,0,7.99,'b:string',90.09,211.11 );")
 			resultSlice := strings.Split(query, ";")
 
 			g.Assert(resultSlice).IsNotNil()
@@ -93,9 +93,9 @@ func TestUpsertBulk(t *testing.T) {
 			g.Assert(resultSlice[0]).Eql("DELETE FROM test WHERE Id = 'a:1'")
 			g.Assert(resultSlice[1]).Eql("DELETE FROM test WHERE Id = 'a:2'")
 			g.Assert(resultSlice[2]).Eql("DELETE FROM test WHERE Id = 'a:3'")
-			g.Assert(resultSlice[3]).Eql("INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Datetime, Column_Datetime2, Column_DatetimeOffset, Column_Varchar, Column_Decimal, Column_Numeric, Column_Date ) VALUES ( 'a:3',12344556,13,41,0,7.990000,'2023-01-01T01:01:01','2023-01-01T00:01:01','2023-01-01T01:01:01+02:00','b:string',90.090000,211.110000,'2023-01-01' )")
+			g.Assert(resultSlice[3]).Eql("INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Datetime, Column_Datetime2, Column_DatetimeOffset, Column_Varchar, Column_Decimal, Column_Numeric, Column_Date ) VALUES ( 'a:3',12344556,13,41,0,7.99,'2023-01-01T01:01:01','2023-01-01T00:01:01','2023-01-01T01:01:01+02:00','b:string',90.09,211.11,'2023-01-01' )")
 			g.Assert(resultSlice[4]).Eql("DELETE FROM test WHERE Id = 'a:4'")
-			g.Assert(resultSlice[5]).Eql("INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Varchar, Column_Decimal, Column_Numeric ) VALUES ( 'a:4',12344556,13,41,0,7.990000,'b:string',90.090000,211.110000 )")
+			g.Assert(resultSlice[5]).Eql("INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Varchar, Column_Decimal, Column_Numeric ) VALUES ( 'a:4',12344556,13,41,0,7.99,'b:string',90.09,211.11 )")
 
 		})
 		g.It("Should emit NULL literals for missing values when nullEmptyColumnValues is set", func() {
@@ -124,7 +124,7 @@ func TestUpsertBulk(t *testing.T) {
 			// a:4 is missing the datetime and date columns
 			query, err := (*layers.PostLayer).CreateUpsertBulk(pl, entities[4:5], pl.PostRepo.PostTableDef.FieldMappings, "DELETE FROM test WHERE Id = ", "Id", "Europe/Oslo", "test")
 			g.Assert(err).IsNil()
-			g.Assert(query).Eql("DELETE FROM test WHERE Id = 'a:4';INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Datetime, Column_Datetime2, Column_DatetimeOffset, Column_Varchar, Column_Decimal, Column_Numeric, Column_Date ) VALUES ( 'a:4',12344556,13,41,0,7.990000,NULL,NULL,NULL,'b:string',90.090000,211.110000,NULL );")
+			g.Assert(query).Eql("DELETE FROM test WHERE Id = 'a:4';INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Datetime, Column_Datetime2, Column_DatetimeOffset, Column_Varchar, Column_Decimal, Column_Numeric, Column_Date ) VALUES ( 'a:4',12344556,13,41,0,7.99,NULL,NULL,NULL,'b:string',90.09,211.11,NULL );")
 		})
 		g.It("Should emit NULL for datetimes outside the target column range", func() {
 			postM, err := os.ReadFile("../../resources/test/test-upsertbulk.json")
@@ -220,6 +220,80 @@ func TestUpsertBulk(t *testing.T) {
 			g.Assert(strings.Contains(err.Error(), "Europe/Osloo")).IsTrue()
 			g.Assert(query).Eql("")
 		})
+		g.It("Should write exact decimals as they are posted", func() {
+			pl := &layers.PostLayer{
+				PostRepo: &layers.PostRepository{
+					PostTableDef: &conf.PostMapping{
+						TableName: "ledger",
+						TimeZone:  "UTC",
+						FieldMappings: []*conf.FieldMapping{
+							{FieldName: "Amount", SortOrder: 1, DataType: "DECIMAL(38,10)"},
+							{FieldName: "Rate", SortOrder: 2, DataType: "FLOAT"},
+						},
+					},
+				},
+			}
+			entity := &layers.Entity{ID: "a:1", Properties: map[string]interface{}{"a:Amount": "12345678901234567890.0123456789", "a:Rate": 0.0000001}}
+
+			payload, err := (*layers.PostLayer).CreatePayload(pl, entity, pl.PostRepo.PostTableDef.FieldMappings)
+			g.Assert(err).IsNil()
+			g.Assert(payload).Eql([]any{"12345678901234567890.0123456789", "0.0000001"})
+
+			entity.Properties["a:Amount"] = "1e10; DROP TABLE ledger"
+			_, err = (*layers.PostLayer).CreatePayload(pl, entity, pl.PostRepo.PostTableDef.FieldMappings)
+			g.Assert(err == nil).IsFalse()
+		})
+		g.It("Should write nested properties back as JSON", func() {
+			pl := &layers.PostLayer{
+				PostRepo: &layers.PostRepository{
+					PostTableDef: &conf.PostMapping{
+						TableName: "orders",
+						TimeZone:  "UTC",
+						FieldMappings: []*conf.FieldMapping{
+							{FieldName: "Id", SortOrder: 1, DataType: "VARCHAR(20)"},
+							{FieldName: "Document", SortOrder: 2, DataType: "NVARCHAR(MAX)"},
+						},
+					},
+				},
+			}
+			entity := &layers.Entity{ID: "a:1", Properties: map[string]interface{}{
+				"a:Id":       "1",
+				"a:Document": map[string]interface{}{"note": "it's", "lines": []interface{}{"a", "b"}},
+			}}
+
+			payload, err := (*layers.PostLayer).CreatePayload(pl, entity, pl.PostRepo.PostTableDef.FieldMappings)
+			g.Assert(err).IsNil()
+			g.Assert(payload).Eql([]any{"1", `{"lines":["a","b"],"note":"it's"}`})
+
+			query, err := (*layers.PostLayer).CreateUpsertBulk(pl, []*layers.Entity{entity}, pl.PostRepo.PostTableDef.FieldMappings, "", "Id", "UTC", "orders")
+			g.Assert(err).IsNil()
+			g.Assert(query).Eql(`DELETE FROM orders WHERE Id = '1';INSERT INTO orders (Id, Document ) VALUES ( '1',N'{"lines":["a","b"],"note":"it''s"}' );`)
+		})
+		g.It("Should delete by the key columns in a composite entity id", func() {
+			pl := &layers.PostLayer{
+				PostRepo: &layers.PostRepository{
+					PostTableDef: &conf.PostMapping{
+						TableName:           "orderlines",
+						EntityIdConstructor: "orderlines/{OrderId}/{LineNo}",
+						FieldMappings: []*conf.FieldMapping{
+							{FieldName: "OrderId", SortOrder: 1, DataType: "VARCHAR(20)"},
+							{FieldName: "LineNo", SortOrder: 2, DataType: "INT"},
+						},
+					},
+				},
+			}
+			deleted := &layers.Entity{ID: "a:orderlines/O%27Brien/3", IsDeleted: true}
+			updated := &layers.Entity{ID: "a:orderlines/A1/4", Properties: map[string]interface{}{"a:OrderId": "A1", "a:LineNo": float64(4)}}
+
+			delQueue, err := (*layers.PostLayer).CustomDelete(pl, deleted, pl.PostRepo.PostTableDef.FieldMappings, deleted.StripProps(), "", "", "")
+			g.Assert(err).IsNil()
+			g.Assert(delQueue).Eql("DELETE FROM orderlines WHERE [OrderId] = N'O''Brien' AND [LineNo] = N'3';")
+
+			query, err := (*layers.PostLayer).CreateUpsertBulk(pl, []*layers.Entity{deleted, updated}, pl.PostRepo.PostTableDef.FieldMappings, "", "", "UTC", "orderlines")
+			g.Assert(err).IsNil()
+			g.Assert(query).Eql("DELETE FROM orderlines WHERE [OrderId] = N'O''Brien' AND [LineNo] = N'3';" +
+				"DELETE FROM orderlines WHERE [OrderId] = N'A1' AND [LineNo] = N'4';INSERT INTO orderlines (OrderId, LineNo ) VALUES ( 'A1',4 );")
+		})
 		g.It("Should create user defined statement", func() {
 			postM, err := os.ReadFile("../../resources/test/test-customquery.json")
 			if err != nil {
@@ -254,7 +328,7 @@ func TestUpsertBulk(t *testing.T) {
 			g.Assert(delTest1).Eql("DELETE FROM test WHERE Id = 'a:1';")
 			g.Assert(delTest2).Eql("DELETE FROM test WHERE Id = 'a:2';")
 			g.Assert(delTest3).Eql("DELETE FROM test WHERE Id = 'a:3';")
-			//DELETE FROM test WHERE Id = 'a:2';DELETE FROM test WHERE Id = 'a:3';INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Datetime, Column_Datetime2, Column_DatetimeOffset, Column_Varchar, Column_Decimal, Column_Numeric, Column_Date ) VALUES ( 'a:3',12344556,13,41,0,7.990000,'2023-01-01T01:01:01','2023-01-01T00:01:01','2023-01-01T01:01:01+02:00','b:string',90.090000,211.110000,'2023-01-01' );")
+			//DELETE FROM test WHERE Id = 'a:2';DELETE FROM test WHERE Id = 'a:3';INSERT INTO test (Id, Column_Int, Column_Tinyint, Column_Smallint, Column_Bit, Column_Float, Column_Datetime, Column_Datetime2, Column_DatetimeOffset, Column_Varchar, Column_Decimal, Column_Numeric, Column_Date ) VALUES ( 'a:3',12344556,13,41,0,7.99,'2023-01-01T01:01:01','2023-01-01T00:01:01','2023-01-01T01:01:01+02:00','b:string',90.09,211.11,'2023-01-01' );")
 		})
 	})
 }
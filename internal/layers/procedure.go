@@ -0,0 +1,63 @@
+package layers
+
+import (
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
+)
+
+// procedureChangeSet reads a dataset from a stored procedure or table valued function. Every
+// result set the procedure returns is read, each with its own columns, and the since token the
+// procedure sets in its since parameter becomes the continuation token.
+func (l *Layer) procedureChangeSet(request db.DatasetRequest, tableDef *conf.TableMapping, tags []string, callBack func(*Entity)) error {
+	query, args, err := db.NewQuery(request, tableDef, l.cmgr.Datalayer).BuildQuery()
+	if err != nil {
+		l.er(err)
+		return err
+	}
+	rows, err := l.Repo.DB.QueryContext(l.Repo.ctx, query, args...)
+	if err != nil {
+		l.er(err)
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for {
+		cols, _ := rows.Columns()
+		colTypes, _ := rows.ColumnTypes()
+		row := buildRowType(cols, colTypes, tableDef)
+		for rows.Next() {
+			if err := rows.Scan(row...); err != nil {
+				l.er(err)
+				return err
+			}
+			_ = l.statsd.Incr("mssql.read", tags, 1)
+			entity, err := l.toEntity(row, cols, colTypes, tableDef)
+			if err != nil {
+				return err
+			}
+			if entity != nil {
+				callBack(entity)
+			}
+		}
+		if !rows.NextResultSet() {
+			break
+		}
+	}
+	if err := rows.Err(); err != nil {
+		l.er(err)
+		return err
+	}
+
+	// output parameters are only set once the results are read to the end
+	_ = rows.Close()
+	if since, ok := db.ProcedureSince(args); ok && !request.Entities {
+		entity := NewEntity()
+		entity.ID = "@continuation"
+		entity.Properties["token"] = since
+
+		callBack(entity)
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package layers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
+)
+
+// delimitedReferences turns a column holding several keys, like "12;44;91", into a reference
+// for each of them. Empty keys are left out.
+func delimitedReferences(value string, delimiter string, template string) []string {
+	refs := make([]string, 0)
+	for _, key := range strings.Split(value, delimiter) {
+		key = strings.TrimSpace(key)
+		if key != "" {
+			refs = append(refs, fmt.Sprintf(template, key))
+		}
+	}
+	return refs
+}
+
+// childReferences reads the keys of the child rows of an entity, aggregated by the query into a
+// JSON array of objects, and returns a reference for each of them.
+func childReferences(text string, child *conf.ChildReference) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(text)))
+	decoder.UseNumber()
+	var rows []map[string]any
+	if err := decoder.Decode(&rows); err != nil {
+		return nil, fmt.Errorf("invalid child rows of %s: %w", child.TableName, err)
+	}
+	refs := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if key, ok := row["v"]; ok && key != nil {
+			refs = append(refs, fmt.Sprintf(child.ReferenceTemplate, key))
+		}
+	}
+	return refs, nil
+}
+
+// foreignKeyReference is a foreign key of a table that points at a table mapped by the layer.
+// The values of its columns make the id of the entity it points at.
+type foreignKeyReference struct {
+	columns       []string
+	target        *conf.TableMapping
+	targetColumns []string
+}
+
+// resolveForeignKeys keeps the foreign keys that point at the id columns of a table mapping
+// with an entity id constructor. Keys pointing at tables not exposed by the layer, or at other
+// columns than the ones the ids are made from, can not be turned into references.
+func resolveForeignKeys(datalayer *conf.Datalayer, fks []*db.ForeignKey) []*foreignKeyReference {
+	refs := make([]*foreignKeyReference, 0)
+	for _, fk := range fks {
+		for _, target := range datalayer.TableMappings {
+			schema := defaultSchema(datalayer.GetSchema(target))
+			if target.EntityIdConstructor == "" || !fk.References(schema, target.TableName) {
+				continue
+			}
+			idColumns := conf.KeyColumns(target.EntityIdConstructor)
+			if idColumns == nil {
+				idColumns = target.IdColumns()
+			}
+			targetColumns, ok := alignColumns(idColumns, fk.ReferencedColumns)
+			if !ok {
+				continue
+			}
+			refs = append(refs, &foreignKeyReference{
+				columns:       fk.Columns,
+				target:        target,
+				targetColumns: targetColumns,
+			})
+			break
+		}
+	}
+	return refs
+}
+
+// reference returns the id of the entity a row points at, from the key values of the row, or
+// false if a column of the foreign key is null.
+func (r *foreignKeyReference) reference(baseUri string, keys map[string]string) (string, bool) {
+	values := make(map[string]string, len(r.columns))
+	for i, column := range r.columns {
+		value, ok := keys[column]
+		if !ok || value == "" {
+			return "", false
+		}
+		values[r.targetColumns[i]] = value
+	}
+	if conf.KeyColumns(r.target.EntityIdConstructor) == nil {
+		return baseUri + fmt.Sprintf(r.target.EntityIdConstructor, values[r.targetColumns[0]]), true
+	}
+	id, err := BuildEntityId(r.target.EntityIdConstructor, values)
+	if err != nil {
+		return "", false
+	}
+	return baseUri + id, true
+}
+
+// alignColumns matches the columns a foreign key points at with the id columns of a table
+// mapping, without case. It returns the id column for each referenced column, or false if the
+// foreign key does not point at exactly the id columns.
+func alignColumns(idColumns []string, referenced []string) ([]string, bool) {
+	if len(idColumns) == 0 || len(idColumns) != len(referenced) {
+		return nil, false
+	}
+	aligned := make([]string, len(referenced))
+	for i, column := range referenced {
+		index := slices.IndexFunc(idColumns, func(id string) bool { return strings.EqualFold(id, column) })
+		if index < 0 {
+			return nil, false
+		}
+		aligned[i] = idColumns[index]
+	}
+	return aligned, true
+}
@@ -0,0 +1,174 @@
+package layers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
+	"github.com/mimiro-io/mssqldatalayer/internal/db"
+)
+
+// DatasetSchema describes what a dataset holds: how it is read and written, and the columns
+// the entities are made from.
+type DatasetSchema struct {
+	Name                string             `json:"name"`
+	IncrementalStrategy string             `json:"incrementalStrategy,omitempty"`
+	TableMapping        *conf.TableMapping `json:"tableMapping,omitempty"`
+	Columns             []*ColumnSchema    `json:"columns,omitempty"`
+	PostMapping         *conf.PostMapping  `json:"postMapping,omitempty"`
+}
+
+// ColumnSchema is a column of the result a dataset is read from, and what it becomes in an entity.
+type ColumnSchema struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Nullable    bool   `json:"nullable"`
+	Property    string `json:"property,omitempty"` // name of the property or reference, empty when ignored
+	IsId        bool   `json:"isId"`
+	IsReference bool   `json:"isReference"`
+	Ignored     bool   `json:"ignored"`
+}
+
+// DatasetSchema describes a dataset read from a table mapping, written to a post mapping, or
+// both. The columns are those of the first row the read of the dataset returns, so they are
+// described for custom queries too. The columns of a procedure or function are those of its
+// first result set, as SQL Server describes it without the procedure being run. User and
+// password settings are left out.
+func (l *Layer) DatasetSchema(datasetName string, post *conf.PostMapping) (*DatasetSchema, error) {
+	tableDef := l.GetTableDefinition(datasetName)
+	if tableDef == nil && post == nil {
+		return nil, fmt.Errorf("could not find defined dataset: %s", datasetName)
+	}
+	schema := &DatasetSchema{Name: datasetName}
+	if post != nil {
+		p := *post
+		p.Config = withoutSecrets(post.Config)
+		schema.PostMapping = &p
+	}
+	if tableDef == nil {
+		return schema, nil
+	}
+
+	t := *tableDef
+	t.Config = withoutSecrets(tableDef.Config)
+	schema.TableMapping = &t
+	schema.IncrementalStrategy = incrementalStrategy(tableDef)
+
+	if err := l.EnsureConnection(tableDef); err != nil {
+		return nil, err
+	}
+	if tableDef.Procedure != nil {
+		// a procedure may change data, so it is described rather than run
+		described, err := db.DescribeResultSet(l.Repo.DB, db.DescribeStatement(tableDef, l.cmgr.Datalayer))
+		if err != nil {
+			return nil, err
+		}
+		columns := make([]*ColumnSchema, len(described))
+		for i, c := range described {
+			columns[i] = &ColumnSchema{Name: c.Name, Type: c.Type, Nullable: c.Nullable}
+		}
+		schema.Columns = describeColumns(tableDef, columns, l.Repo.foreignKeys[tableDef])
+		return schema, nil
+	}
+	query, args, err := db.NewQuery(db.DatasetRequest{DatasetName: datasetName, Limit: 1, Columns: l.tableColumns(tableDef)}, tableDef, l.cmgr.Datalayer).BuildQuery()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := l.Repo.DB.QueryContext(l.Repo.ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	colTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make([]*ColumnSchema, len(colTypes))
+	for i, ct := range colTypes {
+		nullable, _ := ct.Nullable()
+		columns[i] = &ColumnSchema{Name: ct.Name(), Type: ct.DatabaseTypeName(), Nullable: nullable}
+	}
+	schema.Columns = describeColumns(tableDef, columns, l.Repo.foreignKeys[tableDef])
+	return schema, nil
+}
+
+// describeColumns tells what each column becomes in an entity, the way toEntity maps it.
+func describeColumns(tableDef *conf.TableMapping, columns []*ColumnSchema, fks []*foreignKeyReference) []*ColumnSchema {
+	keyColumns := conf.KeyColumns(tableDef.EntityIdConstructor)
+	for _, c := range columns {
+		if strings.HasPrefix(c.Name, db.ChildReferencesColumn) {
+			index, err := strconv.Atoi(strings.TrimPrefix(c.Name, db.ChildReferencesColumn))
+			if err == nil && index < len(tableDef.ChildReferences) {
+				child := tableDef.ChildReferences[index]
+				c.Property = child.PropertyName
+				if c.Property == "" {
+					c.Property = "ns0:" + child.TableName
+				}
+				c.IsReference = true
+			}
+			continue
+		}
+
+		colMapping := tableDef.Columns[c.Name]
+		if (colMapping != nil && colMapping.IgnoreColumn) || (colMapping == nil && ignoreColumn(c.Name, tableDef)) {
+			c.Ignored = true
+			continue
+		}
+		c.Property = "ns0:" + c.Name
+		if colMapping != nil {
+			if colMapping.PropertyName != "" {
+				c.Property = colMapping.PropertyName
+			}
+			c.IsId = colMapping.IsIdColumn
+			c.IsReference = colMapping.IsReference
+		}
+		if keyColumns != nil {
+			c.IsId = slices.Contains(keyColumns, c.Name)
+		}
+		for _, fk := range fks {
+			if fk.columns[0] == c.Name {
+				c.IsReference = true
+			}
+		}
+	}
+	return columns
+}
+
+// incrementalStrategy tells how changes to a dataset are read, in the order db.NewQuery picks them.
+func incrementalStrategy(tableDef *conf.TableMapping) string {
+	template := tableDef.Template()
+	switch {
+	case tableDef.Procedure != nil && tableDef.Procedure.SinceParameter != "":
+		return "procedure"
+	case tableDef.Procedure != nil:
+		return "full"
+	case template != nil && template.Uses("since"):
+		return "sinceQuery"
+	case tableDef.RowVersionColumn != "":
+		return "rowVersion"
+	case tableDef.SinceColumn != "":
+		return "sinceColumn"
+	case tableDef.ChangeTracking:
+		return "changeTracking"
+	case tableDef.CDCEnabled:
+		return "cdc"
+	default:
+		return "full"
+	}
+}
+
+// withoutSecrets returns a copy of a table config without the user and password.
+func withoutSecrets(config *conf.TableConfig) *conf.TableConfig {
+	if config == nil {
+		return nil
+	}
+	c := *config
+	c.User = nil
+	c.Password = nil
+	return &c
+}
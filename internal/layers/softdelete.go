@@ -0,0 +1,51 @@
+package layers
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// softDeleted reports whether the value of a soft delete column marks its row deleted. Without a
+// deleted value a set bit or time marks it, so a deleted_at column and an is_deleted flag both
+// work; columns of other types need one, see conf.TableMapping.ValidateSoftDelete. A number is
+// still only taken as deleted when it is not 0. A deleted value is compared to the text of the
+// column value, with times in RFC3339 and bits as true or false, or 1 or 0.
+func softDeleted(raw interface{}, ctName string, deletedValue string) bool {
+	if v, ok := raw.(*sql.NullBool); ok {
+		if !v.Valid {
+			return false
+		}
+		if deletedValue == "" {
+			return v.Bool
+		}
+		deleted, err := strconv.ParseBool(deletedValue)
+		return err == nil && v.Bool == deleted
+	}
+
+	if v, ok := raw.(*sql.NullFloat64); ok {
+		if !v.Valid {
+			return false
+		}
+		if deletedValue == "" {
+			return v.Float64 != 0
+		}
+		return strconv.FormatFloat(v.Float64, 'f', -1, 64) == deletedValue
+	}
+
+	value, ok := keyValue(raw, ctName)
+	if !ok {
+		return false
+	}
+	if deletedValue == "" {
+		if n, ok := value.(int64); ok {
+			return n != 0
+		}
+		return true
+	}
+	if t, ok := value.(time.Time); ok {
+		value = t.Format(time.RFC3339Nano)
+	}
+	return fmt.Sprint(value) == deletedValue
+}
@@ -0,0 +1,443 @@
+package layers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// geometry is a decoded geography or geometry value. Points and line strings keep their
+// coordinates in points, polygons their rings, and multi shapes and collections their parts.
+// Coordinates are x, y (longitude, latitude for a geography), and z when the value has one.
+type geometry struct {
+	kind   string // the GeoJSON type name
+	points [][]float64
+	rings  [][][]float64
+	parts  []*geometry
+}
+
+// openGisTypes are the shape types of the SQL Server spatial serialization format, by their GeoJSON name.
+var openGisTypes = map[byte]string{
+	1: "Point",
+	2: "LineString",
+	3: "Polygon",
+	4: "MultiPoint",
+	5: "MultiLineString",
+	6: "MultiPolygon",
+	7: "GeometryCollection",
+}
+
+// curveTypes are the shape types of circular arcs, written by SQL Server 2012 and later. Table
+// columns are read with STCurveToLine(), which turns them into lines, so only a custom query
+// can hand them back.
+var curveTypes = map[byte]string{
+	8:  "CircularString",
+	9:  "CompoundCurve",
+	10: "CurvePolygon",
+	11: "FullGlobe",
+}
+
+const (
+	spatialHasZ                = 0x01
+	spatialHasM                = 0x02
+	spatialIsSinglePoint       = 0x08
+	spatialIsSingleLineSegment = 0x10
+)
+
+// decodeSpatial reads the serialized form of a geography or geometry value, as SQL Server
+// hands back the CLR type. A geography stores latitude before longitude, they are swapped so
+// every coordinate comes out as x, y. Circular arcs, as written by SQL Server 2012 and later,
+// are not supported, and fail with an error that says so.
+func decodeSpatial(data []byte, geography bool) (*geometry, error) {
+	r := bytes.NewReader(data)
+	var header struct {
+		Srid       int32
+		Version    uint8
+		Properties uint8
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("invalid spatial value: %w", err)
+	}
+	if header.Version != 1 && header.Version != 2 {
+		return nil, fmt.Errorf("unsupported spatial serialization version %d", header.Version)
+	}
+
+	var pointCount int32
+	switch {
+	case header.Properties&spatialIsSinglePoint != 0:
+		pointCount = 1
+	case header.Properties&spatialIsSingleLineSegment != 0:
+		pointCount = 2
+	default:
+		if err := binary.Read(r, binary.LittleEndian, &pointCount); err != nil {
+			return nil, fmt.Errorf("invalid spatial value: %w", err)
+		}
+	}
+	if pointCount < 0 || int(pointCount)*16 > r.Len() {
+		return nil, errors.New("invalid spatial value: point count out of range")
+	}
+
+	xy := make([]float64, 2*pointCount)
+	if err := binary.Read(r, binary.LittleEndian, xy); err != nil {
+		return nil, fmt.Errorf("invalid spatial value: %w", err)
+	}
+	points := make([][]float64, pointCount)
+	for i := range points {
+		if geography {
+			points[i] = []float64{xy[2*i+1], xy[2*i]}
+		} else {
+			points[i] = []float64{xy[2*i], xy[2*i+1]}
+		}
+	}
+	if header.Properties&spatialHasZ != 0 {
+		z := make([]float64, pointCount)
+		if err := binary.Read(r, binary.LittleEndian, z); err != nil {
+			return nil, fmt.Errorf("invalid spatial value: %w", err)
+		}
+		for i := range points {
+			points[i] = append(points[i], z[i])
+		}
+	}
+	if header.Properties&spatialHasM != 0 {
+		// measures have no place in WKT or GeoJSON
+		if _, err := r.Seek(int64(8*pointCount), io.SeekCurrent); err != nil {
+			return nil, fmt.Errorf("invalid spatial value: %w", err)
+		}
+	}
+
+	switch {
+	case header.Properties&spatialIsSinglePoint != 0:
+		return &geometry{kind: "Point", points: points}, nil
+	case header.Properties&spatialIsSingleLineSegment != 0:
+		return &geometry{kind: "LineString", points: points}, nil
+	}
+
+	var figureCount int32
+	if err := binary.Read(r, binary.LittleEndian, &figureCount); err != nil {
+		return nil, fmt.Errorf("invalid spatial value: %w", err)
+	}
+	if figureCount < 0 || int(figureCount)*5 > r.Len() {
+		return nil, errors.New("invalid spatial value: figure count out of range")
+	}
+	figures := make([]int32, figureCount)
+	for i := range figures {
+		var figure struct {
+			Attribute uint8
+			Offset    int32
+		}
+		if err := binary.Read(r, binary.LittleEndian, &figure); err != nil {
+			return nil, fmt.Errorf("invalid spatial value: %w", err)
+		}
+		// version 2 marks the figures made of arcs, 2 for an arc and 3 for a composite curve
+		if header.Version == 2 && figure.Attribute >= 2 {
+			return nil, errors.New("unsupported spatial value: circular arcs can not be read, select the column with STCurveToLine()")
+		}
+		figures[i] = figure.Offset
+	}
+
+	var shapeCount int32
+	if err := binary.Read(r, binary.LittleEndian, &shapeCount); err != nil {
+		return nil, fmt.Errorf("invalid spatial value: %w", err)
+	}
+	if shapeCount <= 0 || int(shapeCount)*9 > r.Len() {
+		return nil, errors.New("invalid spatial value: shape count out of range")
+	}
+	type shape struct {
+		Parent int32
+		Figure int32
+		Type   uint8
+	}
+	shapes := make([]shape, shapeCount)
+	if err := binary.Read(r, binary.LittleEndian, shapes); err != nil {
+		return nil, fmt.Errorf("invalid spatial value: %w", err)
+	}
+
+	// the points of a figure run up to the next figure, and the figures of a shape up to the
+	// next shape that has any
+	figurePoints := func(f int) ([][]float64, error) {
+		start, end := int(figures[f]), len(points)
+		if f+1 < len(figures) {
+			end = int(figures[f+1])
+		}
+		if start < 0 || start > end || end > len(points) {
+			return nil, errors.New("invalid spatial value: figure out of range")
+		}
+		return points[start:end], nil
+	}
+	shapeFigures := func(s int) (int, int) {
+		start := int(shapes[s].Figure)
+		if start < 0 {
+			return 0, 0
+		}
+		for next := s + 1; next < len(shapes); next++ {
+			if shapes[next].Figure >= 0 {
+				return start, int(shapes[next].Figure)
+			}
+		}
+		return start, len(figures)
+	}
+
+	var build func(s int) (*geometry, error)
+	build = func(s int) (*geometry, error) {
+		kind, ok := openGisTypes[shapes[s].Type]
+		if curve, isCurve := curveTypes[shapes[s].Type]; isCurve {
+			return nil, fmt.Errorf("unsupported spatial shape %s: circular arcs can not be read, select the column with STCurveToLine()", curve)
+		}
+		if !ok {
+			return nil, fmt.Errorf("unsupported spatial shape type %d", shapes[s].Type)
+		}
+		g := &geometry{kind: kind}
+		start, end := shapeFigures(s)
+		if start < 0 || start > end || end > len(figures) {
+			return nil, errors.New("invalid spatial value: shape out of range")
+		}
+		switch kind {
+		case "Point", "LineString":
+			if end > start {
+				p, err := figurePoints(start)
+				if err != nil {
+					return nil, err
+				}
+				g.points = p
+			}
+		case "Polygon":
+			for f := start; f < end; f++ {
+				p, err := figurePoints(f)
+				if err != nil {
+					return nil, err
+				}
+				g.rings = append(g.rings, p)
+			}
+		default:
+			for child := s + 1; child < len(shapes); child++ {
+				if int(shapes[child].Parent) == s {
+					part, err := build(child)
+					if err != nil {
+						return nil, err
+					}
+					g.parts = append(g.parts, part)
+				}
+			}
+		}
+		return g, nil
+	}
+	return build(0)
+}
+
+// WKT returns the geometry as well-known text, in the form STAsText() gives it.
+func (g *geometry) WKT() string {
+	name := strings.ToUpper(g.kind)
+	if g.empty() {
+		return name + " EMPTY"
+	}
+	return name + " " + g.wktBody()
+}
+
+func (g *geometry) empty() bool {
+	return len(g.points) == 0 && len(g.rings) == 0 && len(g.parts) == 0
+}
+
+func (g *geometry) wktBody() string {
+	switch g.kind {
+	case "Point", "LineString":
+		return wktPoints(g.points)
+	case "Polygon":
+		rings := make([]string, len(g.rings))
+		for i, ring := range g.rings {
+			rings[i] = wktPoints(ring)
+		}
+		return "(" + strings.Join(rings, ", ") + ")"
+	case "GeometryCollection":
+		parts := make([]string, len(g.parts))
+		for i, part := range g.parts {
+			parts[i] = part.WKT()
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
+	default:
+		parts := make([]string, len(g.parts))
+		for i, part := range g.parts {
+			parts[i] = part.wktBody()
+		}
+		return "(" + strings.Join(parts, ", ") + ")"
+	}
+}
+
+func wktPoints(points [][]float64) string {
+	coords := make([]string, len(points))
+	for i, point := range points {
+		values := make([]string, len(point))
+		for j, v := range point {
+			values[j] = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		coords[i] = strings.Join(values, " ")
+	}
+	return "(" + strings.Join(coords, ", ") + ")"
+}
+
+// GeoJSON returns the geometry as a GeoJSON geometry object.
+func (g *geometry) GeoJSON() map[string]any {
+	if g.kind == "GeometryCollection" {
+		geometries := make([]any, len(g.parts))
+		for i, part := range g.parts {
+			geometries[i] = part.GeoJSON()
+		}
+		return map[string]any{"type": g.kind, "geometries": geometries}
+	}
+	return map[string]any{"type": g.kind, "coordinates": g.coordinates()}
+}
+
+func (g *geometry) coordinates() any {
+	switch g.kind {
+	case "Point":
+		if len(g.points) == 0 {
+			return []float64{}
+		}
+		return g.points[0]
+	case "LineString":
+		return g.points
+	case "Polygon":
+		return g.rings
+	case "MultiPoint":
+		points := make([][]float64, len(g.parts))
+		for i, part := range g.parts {
+			points[i] = part.coordinates().([]float64)
+		}
+		return points
+	default:
+		parts := make([]any, len(g.parts))
+		for i, part := range g.parts {
+			parts[i] = part.coordinates()
+		}
+		return parts
+	}
+}
+
+// parseGeoJSON reads a posted GeoJSON geometry, or the geometry of a GeoJSON feature.
+func parseGeoJSON(value map[string]any) (*geometry, error) {
+	kind, _ := value["type"].(string)
+	if kind == "Feature" {
+		inner, ok := value["geometry"].(map[string]any)
+		if !ok {
+			return nil, errors.New("GeoJSON feature without a geometry")
+		}
+		return parseGeoJSON(inner)
+	}
+
+	g := &geometry{kind: kind}
+	if kind == "GeometryCollection" {
+		geometries, _ := value["geometries"].([]any)
+		for _, item := range geometries {
+			inner, ok := item.(map[string]any)
+			if !ok {
+				return nil, errors.New("GeoJSON geometry collection holds a value that is not a geometry")
+			}
+			part, err := parseGeoJSON(inner)
+			if err != nil {
+				return nil, err
+			}
+			g.parts = append(g.parts, part)
+		}
+		return g, nil
+	}
+
+	coordinates, _ := value["coordinates"].([]any)
+	var err error
+	switch kind {
+	case "Point":
+		if len(coordinates) > 0 {
+			var point []float64
+			point, err = geoJSONPoint(coordinates)
+			g.points = [][]float64{point}
+		}
+	case "LineString":
+		g.points, err = geoJSONPoints(coordinates)
+	case "Polygon":
+		g.rings, err = geoJSONRings(coordinates)
+	case "MultiPoint", "MultiLineString", "MultiPolygon":
+		member := strings.TrimPrefix(kind, "Multi")
+		for _, item := range coordinates {
+			inner, _ := item.([]any)
+			part, perr := parseGeoJSON(map[string]any{"type": member, "coordinates": inner})
+			if perr != nil {
+				return nil, perr
+			}
+			g.parts = append(g.parts, part)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported GeoJSON type %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+func geoJSONPoint(value []any) ([]float64, error) {
+	if len(value) < 2 || len(value) > 3 {
+		return nil, errors.New("GeoJSON position must have 2 or 3 coordinates")
+	}
+	point := make([]float64, len(value))
+	for i, v := range value {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("GeoJSON coordinate %v is not a number", v)
+		}
+		point[i] = f
+	}
+	return point, nil
+}
+
+func geoJSONPoints(value []any) ([][]float64, error) {
+	points := make([][]float64, len(value))
+	for i, item := range value {
+		position, _ := item.([]any)
+		point, err := geoJSONPoint(position)
+		if err != nil {
+			return nil, err
+		}
+		points[i] = point
+	}
+	return points, nil
+}
+
+func geoJSONRings(value []any) ([][][]float64, error) {
+	rings := make([][][]float64, len(value))
+	for i, item := range value {
+		ring, _ := item.([]any)
+		points, err := geoJSONPoints(ring)
+		if err != nil {
+			return nil, err
+		}
+		rings[i] = points
+	}
+	return rings, nil
+}
+
+// wktPattern matches the characters well-known text is made of, so a posted value can be
+// placed in a statement without being able to end the string it is in.
+var wktPattern = regexp.MustCompile(`^[0-9A-Za-z .,()+\-]*$`)
+
+// spatialText returns a posted geography or geometry value as well-known text. It is either
+// WKT already, or a GeoJSON geometry.
+func spatialText(value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		if !wktPattern.MatchString(v) {
+			return "", fmt.Errorf("%q is not well-known text", v)
+		}
+		return v, nil
+	case map[string]any:
+		g, err := parseGeoJSON(v)
+		if err != nil {
+			return "", err
+		}
+		return g.WKT(), nil
+	default:
+		return "", fmt.Errorf("%v is neither well-known text nor GeoJSON", value)
+	}
+}
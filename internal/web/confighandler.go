@@ -0,0 +1,53 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/mimiro-io/mssqldatalayer/internal/layers"
+	"go.uber.org/fx"
+	"go.uber.org/zap"
+)
+
+type configHandler struct {
+	logger *zap.SugaredLogger
+	layer  *layers.Layer
+}
+
+func NewConfigHandler(lc fx.Lifecycle, e *echo.Echo, logger *zap.SugaredLogger, mw *Middleware, layer *layers.Layer) {
+	log := logger.Named("web")
+
+	handler := &configHandler{
+		logger: log,
+		layer:  layer,
+	}
+	lc.Append(fx.Hook{
+		OnStart: func(ctx context.Context) error {
+			e.GET("/config/generate", handler.generateConfigHandler, mw.authorizer(log, "datahub:w"))
+			return nil
+		},
+	})
+}
+
+// generateConfigHandler
+// query param schemas, tables: comma separated lists, all tables of the configured schema by default
+func (handler *configHandler) generateConfigHandler(c echo.Context) error {
+	config, err := handler.layer.GenerateConfig(splitList(c.QueryParam("schemas")), splitList(c.QueryParam("tables")))
+	if err != nil {
+		handler.logger.Warn(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSONPretty(http.StatusOK, config, "  ")
+}
+
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
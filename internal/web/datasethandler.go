@@ -3,11 +3,15 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v4"
+	"github.com/mimiro-io/mssqldatalayer/internal/conf"
 	"github.com/mimiro-io/mssqldatalayer/internal/db"
 	"github.com/mimiro-io/mssqldatalayer/internal/layers"
 	"go.uber.org/fx"
@@ -20,22 +24,25 @@ type ServiceInfo struct {
 }
 
 type datasetHandler struct {
-	logger *zap.SugaredLogger
-	layer  *layers.Layer
+	logger    *zap.SugaredLogger
+	layer     *layers.Layer
+	postLayer *layers.PostLayer
 }
 
-func NewDatasetHandler(lc fx.Lifecycle, e *echo.Echo, logger *zap.SugaredLogger, mw *Middleware, layer *layers.Layer) {
+func NewDatasetHandler(lc fx.Lifecycle, e *echo.Echo, logger *zap.SugaredLogger, mw *Middleware, layer *layers.Layer, postLayer *layers.PostLayer) {
 	log := logger.Named("web")
 
 	dh := &datasetHandler{
-		logger: log,
-		layer:  layer,
+		logger:    log,
+		layer:     layer,
+		postLayer: postLayer,
 	}
 	lc.Append(fx.Hook{
 		OnStart: func(ctx context.Context) error {
 			e.GET("/datasets", dh.listDatasetsHandler, mw.authorizer(log, "datahub:r"))
 			e.GET("/datasets/:dataset/changes", dh.getChangesHandler, mw.authorizer(log, "datahub:r"))
-			e.GET("/datasets/:dataset/entities", dh.getChangesHandler, mw.authorizer(log, "datahub:r"))
+			e.GET("/datasets/:dataset/entities", dh.getEntitiesHandler, mw.authorizer(log, "datahub:r"))
+			e.GET("/datasets/:dataset/schema", dh.getSchemaHandler, mw.authorizer(log, "datahub:r"))
 			return nil
 		},
 	})
@@ -56,47 +63,36 @@ func (handler *datasetHandler) listDatasetsHandler(c echo.Context) error {
 
 // getEntitiesHandler
 // path param dataset
-// query param continuationToken
+// query param from, limit
 func (handler *datasetHandler) getEntitiesHandler(c echo.Context) error {
 	datasetName, err := url.QueryUnescape(c.Param("dataset"))
 	if err != nil {
+		handler.logger.Warn(err)
 		return c.NoContent(http.StatusBadRequest)
 	}
-	limit := c.QueryParam("limit")
-	var l int64
-	if limit != "" {
-		f, _ := strconv.ParseInt(limit, 10, 64)
-		l = f
-	}
 
-	// check dataset exists
-	if !handler.layer.DoesDatasetExist(datasetName) {
-		return c.NoContent(http.StatusNotFound)
+	from := c.QueryParam("from")
+	if from != "" {
+		f, _ := url.QueryUnescape(from)
+		from = f
 	}
 
-	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-	c.Response().WriteHeader(http.StatusOK)
-	enc := json.NewEncoder(c.Response())
-	c.Response().Write([]byte("["))
-
-	// make and send context as the first object
-	context := handler.layer.GetContext(datasetName)
-
-	_ = enc.Encode(context)
+	tableDef := handler.layer.GetTableDefinition(datasetName)
+	filters, fields, err := parseFilters(c, tableDef)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
 	request := db.DatasetRequest{
 		DatasetName: datasetName,
-		Limit:       l,
+		Limit:       parseLimit(c.QueryParam("limit")),
+		Entities:    true,
+		From:        from,
+		Filters:     filters,
+		Fields:      fields,
+		Params:      procedureParams(c, tableDef),
 	}
-	handler.layer.ChangeSet(request, func(entity *layers.Entity) {
-		c.Response().Write([]byte(","))
-		_ = enc.Encode(entity)
-		c.Response().Flush()
-	})
-
-	c.Response().Write([]byte("]"))
-	c.Response().Flush()
-	return nil
+	return handler.streamChangeSet(c, request)
 }
 
 func (handler *datasetHandler) getChangesHandler(c echo.Context) error {
@@ -112,12 +108,105 @@ func (handler *datasetHandler) getChangesHandler(c echo.Context) error {
 		since = s
 	}
 
-	limit := c.QueryParam("limit")
+	tableDef := handler.layer.GetTableDefinition(datasetName)
+	filters, fields, err := parseFilters(c, tableDef)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	request := db.DatasetRequest{
+		DatasetName: datasetName,
+		Since:       since,
+		Limit:       parseLimit(c.QueryParam("limit")),
+		Filters:     filters,
+		Fields:      fields,
+		Params:      procedureParams(c, tableDef),
+	}
+	return handler.streamChangeSet(c, request)
+}
+
+// getSchemaHandler
+// path param dataset
+func (handler *datasetHandler) getSchemaHandler(c echo.Context) error {
+	datasetName, err := url.QueryUnescape(c.Param("dataset"))
+	if err != nil {
+		handler.logger.Warn(err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	post := handler.postLayer.GetTableDefinition(datasetName)
+	if !handler.layer.DoesDatasetExist(datasetName) && post == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+
+	schema, err := handler.layer.DatasetSchema(datasetName, post)
+	if err != nil {
+		handler.logger.Warn(err)
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, schema)
+}
+
+// requestParams are the query parameters that are not filters
+var requestParams = []string{"since", "limit", "from", "fields"}
+
+// parseFilters reads the filters and fields of a read. A query parameter named after a mapped
+// property of the dataset is a filter on it, like Country=eq.NO, and a parameter given more than
+// once makes a filter of each, so Amount=gte.10&Amount=lt.20 is a range. Any other parameter,
+// like a cache buster, is left alone, as are those passed on to a procedure or query template.
+func parseFilters(c echo.Context, tableDef *conf.TableMapping) ([]db.Filter, []string, error) {
+	filters := make([]db.Filter, 0)
+	if tableDef == nil {
+		return filters, nil, nil
+	}
+	for property, values := range c.QueryParams() {
+		if slices.Contains(requestParams, property) || slices.Contains(tableDef.QueryParams(), property) || tableDef.PropertyColumn(property) == "" {
+			continue
+		}
+		for _, value := range values {
+			filter, err := db.ParseFilter(property, value)
+			if err != nil {
+				return nil, nil, err
+			}
+			filters = append(filters, filter)
+		}
+	}
+	var fields []string
+	for _, field := range strings.Split(c.QueryParam("fields"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return filters, fields, nil
+}
+
+// procedureParams returns the values of the query parameters a dataset passes on to its
+// procedure or query template that are given in the request.
+func procedureParams(c echo.Context, tableDef *conf.TableMapping) map[string]string {
+	values := make(map[string]string)
+	if tableDef == nil {
+		return values
+	}
+	for _, param := range tableDef.QueryParams() {
+		if c.QueryParams().Has(param) {
+			values[param] = c.QueryParam(param)
+		}
+	}
+	return values
+}
+
+func parseLimit(limit string) int64 {
 	var l int64
 	if limit != "" {
 		f, _ := strconv.ParseInt(limit, 10, 64)
 		l = f
 	}
+	return l
+}
+
+// streamChangeSet writes the result of the request as an entity collection
+func (handler *datasetHandler) streamChangeSet(c echo.Context, request db.DatasetRequest) error {
+	datasetName := request.DatasetName
 
 	// check dataset exists
 	if !handler.layer.DoesDatasetExist(datasetName) {
@@ -127,29 +216,33 @@ func (handler *datasetHandler) getChangesHandler(c echo.Context) error {
 	// ensure db connection before starting json stream
 	tableDef := handler.layer.GetTableDefinition(datasetName)
 
-	err = handler.layer.EnsureConnection(tableDef)
+	err := handler.layer.EnsureConnection(tableDef)
 	if err != nil {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-	c.Response().WriteHeader(http.StatusOK)
+	// the response is started with the first entity, so an error before that can still be
+	// sent as a status code
 	enc := json.NewEncoder(c.Response())
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		c.Response().WriteHeader(http.StatusOK)
 
-	c.Response().Write([]byte("["))
-
-	// make and send context as the first object
-	context := handler.layer.GetContext(datasetName)
+		c.Response().Write([]byte("["))
 
-	_ = enc.Encode(context)
+		// make and send context as the first object
+		context := handler.layer.GetContext(datasetName)
 
-	request := db.DatasetRequest{
-		DatasetName: datasetName,
-		Since:       since,
-		Limit:       l,
+		_ = enc.Encode(context)
 	}
 
 	err = handler.layer.ChangeSet(request, func(entity *layers.Entity) {
+		start()
 		if entity.ID == "@continuation" { // it is returned as a normal entity, and we need to flatten it to the token format
 			cont := map[string]interface{}{
 				"id":    "@continuation",
@@ -165,10 +258,21 @@ func (handler *datasetHandler) getChangesHandler(c echo.Context) error {
 		}
 	})
 
-	if err != nil {
+	if err != nil && !started {
+		handler.logger.Warn(err)
+		if errors.Is(err, layers.ErrTokenExpired) {
+			// tells the client to drop its token and read the dataset from the start
+			return echo.NewHTTPError(http.StatusGone, err.Error())
+		}
+		if errors.Is(err, db.ErrInvalidRequest) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	} else if err != nil {
 		// dont write the closing bracket and imply to the client through this that the stream is broken
 		handler.logger.Warn(err)
 	} else {
+		start()
 		c.Response().Write([]byte("]"))
 		c.Response().Flush()
 	}